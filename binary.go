@@ -0,0 +1,101 @@
+package main
+
+// Which redis-server binaries to compare against.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	defaultBinary = "redis-server"
+	// binaryEnv has the binaries, separated by the OS path separator (':').
+	binaryEnv = "REDIS_SERVER"
+)
+
+var binaryFlag = flag.String("redis-server", "", "redis-server binaries to test against, separated by ':'. Default is $"+binaryEnv+", or redis-server from $PATH")
+
+// binary is a redis-server executable we found.
+type binary struct {
+	path string
+	name string // for subtests: "redis-7.0.5"
+}
+
+var (
+	binariesOnce  sync.Once
+	binaries      []binary
+	binariesTried []string
+)
+
+// findBinaries returns the binaries from the flag or the env, which exist.
+func findBinaries() ([]binary, []string) {
+	binariesOnce.Do(func() {
+		list := *binaryFlag
+		if list == "" {
+			list = os.Getenv(binaryEnv)
+		}
+		if list == "" {
+			list = defaultBinary
+		}
+		seen := map[string]bool{}
+		for _, b := range filepath.SplitList(list) {
+			if b == "" {
+				continue
+			}
+			binariesTried = append(binariesTried, b)
+			path, err := exec.LookPath(b)
+			if err != nil {
+				continue
+			}
+			base := binaryName(path)
+			name := base
+			for n := 2; seen[name]; n++ {
+				name = fmt.Sprintf("%s#%d", base, n)
+			}
+			seen[name] = true
+			binaries = append(binaries, binary{path: path, name: name})
+		}
+	})
+	return binaries, binariesTried
+}
+
+var versionRe = regexp.MustCompile(`v=(\d+\.\d+\.\d+)`)
+
+// binaryName is "redis-" and the version from --version, or the file name.
+func binaryName(path string) string {
+	out, err := exec.Command(path, "--version").Output()
+	if err == nil {
+		if m := versionRe.FindSubmatch(out); m != nil {
+			return "redis-" + string(m[1])
+		}
+	}
+	return filepath.Base(path)
+}
+
+// withBinaries runs f with every redis-server we have. If there is more than
+// one they are subtests, named after the version. Skips the test if there are
+// none.
+func withBinaries(t *testing.T, f func(t *testing.T, bin string)) {
+	t.Helper()
+	bs, tried := findBinaries()
+	switch len(bs) {
+	case 0:
+		t.Skipf("no redis-server found (tried: %s). Use -redis-server or $%s", strings.Join(tried, ", "), binaryEnv)
+	case 1:
+		f(t, bs[0].path)
+	default:
+		for _, b := range bs {
+			b := b
+			t.Run(b.name, func(t *testing.T) {
+				f(t, b.path)
+			})
+		}
+	}
+}
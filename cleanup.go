@@ -0,0 +1,152 @@
+package main
+
+// Make sure no redis-server outlives us, not even after a crash.
+//
+// Every run has its own temp dir, with our pid in "owner", and a
+// "redis-<pid>.pid" file for every running redis-server. The next run kills
+// whatever is left in the dirs of runs which are gone.
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const runDirPrefix = "miniredis_vs_redis-run-"
+
+var (
+	runDirOnce sync.Once
+	runDirPath string
+	runDirErr  error
+
+	// processes are the running redis-servers.
+	processes = struct {
+		sync.Mutex
+		m map[*ephemeral]bool
+	}{m: map[*ephemeral]bool{}}
+)
+
+// runDir is the temp dir for this run. redis-servers run in it, so a
+// dump.rdb never ends up in the repo.
+func runDir() (string, error) {
+	runDirOnce.Do(func() {
+		runDirPath, runDirErr = os.MkdirTemp("", runDirPrefix)
+		if runDirErr != nil {
+			return
+		}
+		runDirErr = os.WriteFile(filepath.Join(runDirPath, "owner"), []byte(strconv.Itoa(os.Getpid())), 0600)
+	})
+	return runDirPath, runDirErr
+}
+
+// tempDir makes a new dir in the run dir.
+func tempDir() (string, error) {
+	dir, err := runDir()
+	if err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(dir, "tmp")
+}
+
+// register keeps track of a started redis-server.
+func register(e *ephemeral) {
+	processes.Lock()
+	defer processes.Unlock()
+	processes.m[e] = true
+	if dir, err := runDir(); err == nil {
+		os.WriteFile(pidFile(dir, e.cmd.Process.Pid), nil, 0600)
+	}
+}
+
+// unregister is for stopped redis-servers.
+func unregister(e *ephemeral) {
+	processes.Lock()
+	defer processes.Unlock()
+	delete(processes.m, e)
+	if dir, err := runDir(); err == nil {
+		os.Remove(pidFile(dir, e.cmd.Process.Pid))
+	}
+}
+
+func pidFile(dir string, pid int) string {
+	return filepath.Join(dir, fmt.Sprintf("redis-%d.pid", pid))
+}
+
+// killAll stops every redis-server we started, and removes the run dir.
+func killAll() {
+	processes.Lock()
+	var es []*ephemeral
+	for e := range processes.m {
+		es = append(es, e)
+	}
+	processes.Unlock()
+	for _, e := range es {
+		e.Close()
+	}
+	if runDirPath != "" {
+		os.RemoveAll(runDirPath)
+	}
+}
+
+// killOnSignal cleans up on ^C, or when we get killed nicely.
+func killOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-c
+		killAll()
+		fmt.Fprintf(os.Stderr, "%s: stopped all redis-servers\n", s)
+		os.Exit(1)
+	}()
+}
+
+// sweep kills the redis-servers of earlier runs which didn't clean up after
+// themselves, and removes their run dirs. Returns how many it killed.
+func sweep() int {
+	dirs, _ := filepath.Glob(filepath.Join(os.TempDir(), runDirPrefix+"*"))
+	killed := 0
+	for _, dir := range dirs {
+		if dir == runDirPath {
+			continue
+		}
+		owner, err := os.ReadFile(filepath.Join(dir, "owner"))
+		if err != nil {
+			continue // not ours, or still starting
+		}
+		if pid, err := strconv.Atoi(string(owner)); err != nil || alive(pid) {
+			continue
+		}
+		pids, _ := filepath.Glob(filepath.Join(dir, "redis-*.pid"))
+		for _, f := range pids {
+			pid, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), "redis-"), ".pid"))
+			if err != nil || !alive(pid) || !isRedis(pid) {
+				continue
+			}
+			if p, err := os.FindProcess(pid); err == nil && p.Kill() == nil {
+				killed++
+			}
+		}
+		os.RemoveAll(dir)
+	}
+	return killed
+}
+
+func alive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// isRedis checks that the pid wasn't reused by something else.
+func isRedis(pid int) bool {
+	out, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	return err == nil && strings.Contains(string(out), "redis")
+}
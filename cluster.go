@@ -0,0 +1,251 @@
+package main
+
+// A local Redis Cluster.
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	clusterSlots = 16384
+	// clusterNodes is how many masters testClusterCommands starts.
+	clusterNodes = 3
+	// clusterTimeout is how long the cluster gets to reach cluster_state:ok.
+	clusterTimeout = 20 * time.Second
+	// maxRedirects is how many MOVED replies we follow for a command.
+	maxRedirects = 5
+	// clusterBusOffset is the cluster bus port, relative to the port. Redis 7
+	// has cluster-port, but older versions don't.
+	clusterBusOffset = 10000
+)
+
+// cluster is a Redis Cluster, with only masters.
+type cluster struct {
+	nodes   []*ephemeral
+	addrs   []string
+	dir     string // for the nodes.conf files
+	version string
+}
+
+// RedisCluster starts n nodes with cluster-enabled, assigns all slots, and
+// waits until the cluster is ok. They always use TCP. Close() it when done.
+func RedisCluster(o Options, n int) (*cluster, error) {
+	dir, err := tempDir()
+	if err != nil {
+		return nil, err
+	}
+	cl := &cluster{dir: dir}
+	o.tcp = true
+	o.clusterBus = true
+	extra := o.Extra
+	for i := 0; i < n; i++ {
+		o.Extra = append(append([]string(nil), extra...),
+			"cluster-enabled yes",
+			fmt.Sprintf("cluster-config-file %s", filepath.Join(dir, fmt.Sprintf("nodes-%d.conf", i))),
+			"cluster-node-timeout 5000",
+			fmt.Sprintf("dir %s", dir),
+		)
+		e, addr, err := runRedis(o)
+		if err != nil {
+			cl.Close()
+			return nil, fmt.Errorf("node %d: %s", i, err)
+		}
+		cl.nodes = append(cl.nodes, e)
+		cl.addrs = append(cl.addrs, addr)
+	}
+	if err := cl.setup(); err != nil {
+		err = fmt.Errorf("%s%s", err, cl.output())
+		cl.Close()
+		return nil, err
+	}
+	return cl, nil
+}
+
+// setup assigns the slots, introduces the nodes to each other, and waits
+// until everybody agrees.
+func (cl *cluster) setup() error {
+	for i, addr := range cl.addrs {
+		c, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			cl.version = serverVersion(c)
+		}
+		// ADDSLOTSRANGE is only in 7.0
+		from, to := i*clusterSlots/len(cl.addrs), (i+1)*clusterSlots/len(cl.addrs)
+		var slots []interface{}
+		for s := from; s < to; s++ {
+			slots = append(slots, s)
+		}
+		if _, err := c.Do("CLUSTER", append([]interface{}{"ADDSLOTS"}, slots...)...); err != nil {
+			c.Close()
+			return fmt.Errorf("node %d: ADDSLOTS: %s", i, err)
+		}
+		if i > 0 {
+			host, port, _ := net.SplitHostPort(cl.addrs[0])
+			if _, err := c.Do("CLUSTER", "MEET", host, port); err != nil {
+				c.Close()
+				return fmt.Errorf("node %d: MEET: %s", i, err)
+			}
+		}
+		c.Close()
+	}
+
+	timeout := time.Now().Add(clusterTimeout)
+	for _, addr := range cl.addrs {
+		for {
+			info, err := clusterInfo(addr)
+			if err != nil {
+				return err
+			}
+			if infoField(info, "cluster_state") == "ok" &&
+				infoField(info, "cluster_known_nodes") == fmt.Sprint(len(cl.addrs)) {
+				break
+			}
+			if time.Now().After(timeout) {
+				return fmt.Errorf("cluster not ok after %s: %s: %s", clusterTimeout, addr, info)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+func clusterInfo(addr string) (string, error) {
+	c, err := redis.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	return redis.String(c.Do("CLUSTER", "INFO"))
+}
+
+func (cl *cluster) output() string {
+	var out string
+	for i, n := range cl.nodes {
+		out += fmt.Sprintf("\nnode %d output:\n%s", i, n.log)
+	}
+	return out
+}
+
+func (cl *cluster) Close() {
+	for _, n := range cl.nodes {
+		n.Close()
+	}
+	os.RemoveAll(cl.dir)
+}
+
+// clusterConn is a redis.Conn which follows MOVED redirects, the way cluster
+// clients do.
+type clusterConn struct {
+	redis.Conn
+	conns map[string]redis.Conn
+}
+
+func dialCluster(addr string) (*clusterConn, error) {
+	c, err := redis.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterConn{
+		Conn:  c,
+		conns: map[string]redis.Conn{addr: c},
+	}, nil
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	conn := c.Conn
+	for i := 0; ; i++ {
+		v, err := conn.Do(cmd, args...)
+		rerr, ok := err.(redis.Error)
+		if !ok || !strings.HasPrefix(string(rerr), "MOVED ") || i >= maxRedirects {
+			return v, err
+		}
+		// MOVED 3999 127.0.0.1:6381
+		f := strings.Fields(string(rerr))
+		if len(f) != 3 {
+			return v, err
+		}
+		if conn = c.conns[f[2]]; conn == nil {
+			if conn, err = redis.Dial("tcp", f[2]); err != nil {
+				return nil, err
+			}
+			c.conns[f[2]] = conn
+		}
+	}
+}
+
+func (c *clusterConn) Close() error {
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// compareClusterKeyspace fails the test if the keys of all nodes together
+// differ from miniredis.
+func compareClusterKeyspace(t *testing.T, nodes []string, miniAddr string) {
+	t.Helper()
+	ksReal := keyspace{}
+	for _, addr := range nodes {
+		ks, err := dumpKeyspace(addr)
+		if err != nil {
+			t.Errorf("realredis keyspace: %s", err)
+			return
+		}
+		for db, keys := range ks {
+			if ksReal[db] == nil {
+				ksReal[db] = map[string]keyEntry{}
+			}
+			for k, e := range keys {
+				ksReal[db][k] = e
+			}
+		}
+	}
+	ksMini, err := dumpKeyspace(miniAddr)
+	if err != nil {
+		t.Errorf("miniredis keyspace: %s", err)
+		return
+	}
+	reportKeyspace(t, diffKeyspace(ksReal, ksMini))
+}
+
+// like testCommands, but realredis is a cluster. Commands go to the first
+// node, and MOVED replies are followed.
+func testClusterCommands(t *testing.T, commands ...command) {
+	t.Helper()
+	withBinaries(t, func(t *testing.T, bin string) {
+		sMini, err := miniredis.Run()
+		ok(t, err)
+		defer sMini.Close()
+
+		cl, err := RedisCluster(Options{Binary: bin}, clusterNodes)
+		if err != nil {
+			t.Fatalf("realredis: %s", err)
+		}
+		t.Cleanup(cl.Close)
+
+		cReal, err := dialCluster(cl.addrs[0])
+		ok(t, err)
+		defer cReal.Close()
+		cMini, err := redis.Dial("tcp", sMini.Addr())
+		ok(t, err)
+		defer cMini.Close()
+
+		// no triage: a single node doesn't have the whole keyspace
+		for _, c := range versionGate(t, cl.version, commands) {
+			runCommand(t, noTriage(cl.version), cMini, cReal, c)
+		}
+		compareClusterKeyspace(t, cl.addrs, sMini.Addr())
+	})
+}
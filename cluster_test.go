@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCluster(t *testing.T) {
+	// Miniredis has no cluster mode, see known_divergences.json for where that
+	// shows.
+	testClusterCommands(t,
+		succ("CLUSTER", "KEYSLOT", "foo"),
+		succ("CLUSTER", "KEYSLOT", "{user1}.following"),
+		succ("CLUSTER", "KEYSLOT", "{}foo"),
+		succ("SET", "foo", "bar"),
+		succ("GET", "foo"),
+		succ("SET", "baz", "bak"),
+		succ("GET", "baz"),
+
+		// hash tags
+		succ("MSET", "{user1}a", "1", "{user1}b", "2"),
+		succ("MGET", "{user1}a", "{user1}b"),
+		succ("SUNIONSTORE", "{user2}dst", "{user2}a", "{user2}b"),
+		succ("EVAL", "return redis.call('GET', KEYS[1])", 1, "{user1}a"),
+
+		// keys in different slots
+		fail("MGET", "foo", "baz"),
+		fail("SUNIONSTORE", "dst", "a", "b"),
+
+		// only db 0
+		fail("SELECT", 1),
+	)
+}
@@ -0,0 +1,247 @@
+package main
+
+// Known divergences between miniredis and Redis, from known_divergences.json.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/build"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+const (
+	divergencesFile = "known_divergences.json"
+	miniredisPkg    = "github.com/alicebob/miniredis"
+)
+
+// issueLink is what the issue of a known divergence looks like: a miniredis
+// issue or pull request.
+var issueLink = regexp.MustCompile(`^https://github\.com/alicebob/miniredis/(issues|pull)/[0-9]+$`)
+
+var miniredisVersionFlag = flag.String("miniredis-version", "", "the miniredis version we're built with, for fixed_in in "+divergencesFile+". Default is from the build info, or from git")
+
+// divergence is an accepted difference for a command in a test.
+type divergence struct {
+	Test      string `json:"test"`                // test name. Subtests match their parent's name.
+	Command   string `json:"command"`             // glob on the command and its arguments: "EVAL return*"
+	Reason    string `json:"reason"`              // why we accept this
+	Issue     string `json:"issue"`               // miniredis issue or pull request
+	Untracked bool   `json:"untracked,omitempty"` // there is no issue yet, and Issue is ""
+	Random    bool   `json:"random,omitempty"`    // miniredis only diverges some of the time
+	FixedIn   string `json:"fixed_in,omitempty"`  // miniredis version which should fix this
+	Since     string `json:"since,omitempty"`     // only for realredis versions from this one
+	Before    string `json:"before,omitempty"`    // only for realredis versions before this one
+
+	command *regexp.Regexp // Command, compiled
+}
+
+func (d divergence) String() string {
+	return fmt.Sprintf("%s %q", d.Test, d.Command)
+}
+
+var (
+	divergencesOnce sync.Once
+	divergences     []divergence
+	divergencesErr  error
+)
+
+func loadDivergences() ([]divergence, error) {
+	divergencesOnce.Do(func() {
+		b, err := os.ReadFile(divergencesFile)
+		if err != nil {
+			divergencesErr = err
+			return
+		}
+		if err := json.Unmarshal(b, &divergences); err != nil {
+			divergencesErr = fmt.Errorf("%s: %s", divergencesFile, err)
+			return
+		}
+		for i, d := range divergences {
+			if d.Test == "" || d.Command == "" || d.Reason == "" {
+				divergencesErr = fmt.Errorf("%s: test, command, and reason are required: %#v", divergencesFile, d)
+				return
+			}
+			switch {
+			case d.Untracked && d.Issue != "":
+				divergencesErr = fmt.Errorf("%s: %s has an issue, but is untracked", divergencesFile, d)
+				return
+			case !d.Untracked && !issueLink.MatchString(d.Issue):
+				divergencesErr = fmt.Errorf("%s: %s needs a miniredis issue or pull request (%s), or \"untracked\": true", divergencesFile, d, issueLink)
+				return
+			}
+			if d.FixedIn != "" && miniredisVersion() == "" {
+				divergencesErr = fmt.Errorf("%s: %s has fixed_in, but we don't know the miniredis version. Use -miniredis-version", divergencesFile, d)
+				return
+			}
+			divergences[i].command = globRegexp(d.Command)
+		}
+	})
+	return divergences, divergencesErr
+}
+
+// findDivergence returns the known divergence for a command with a realredis
+// version, if any. The first match wins, so specific entries go first.
+func findDivergence(name, version string, p command) (*divergence, error) {
+	ds, err := loadDivergences()
+	if err != nil {
+		return nil, err
+	}
+	line := commandLine(p)
+	for i, d := range ds {
+		if name != d.Test && !strings.HasPrefix(name, d.Test+"/") {
+			continue
+		}
+		if !inVersions(version, d.Since, d.Before) {
+			continue
+		}
+		if d.command.MatchString(line) {
+			return &ds[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// expired is true if we run with the miniredis version which should have
+// fixed this.
+func (d divergence) expired() bool {
+	if d.FixedIn == "" {
+		return false
+	}
+	v := miniredisVersion()
+	return v != "" && compareVersions(v, d.FixedIn) >= 0
+}
+
+// compareKnown runs a comparison and reports the differences, taking the
+// known divergences for the realredis version into account. A known divergence which doesn't diverge
+// is an error, so the list stays honest. Unless it's random: miniredis does
+// the same thing as Redis some of the time.
+func compareKnown(t reporter, version string, p command, cmp func(reporter)) {
+	t.Helper()
+	d, err := findDivergence(t.Name(), version, p)
+	if err != nil {
+		t.Errorf("known divergences: %s", err)
+	}
+	if d == nil {
+		cmp(t)
+		return
+	}
+
+	rec := &recorder{name: t.Name()}
+	cmp(rec)
+	for _, l := range rec.logs {
+		t.Logf("%s", l)
+	}
+	switch {
+	case len(rec.errors) == 0:
+		if !d.Random {
+			t.Errorf("known divergence %s doesn't diverge anymore. Please remove it from %s. case: %#v", d, divergencesFile, p)
+		}
+	case d.expired():
+		for _, e := range rec.errors {
+			t.Errorf("%s (known divergence %s, should be fixed in miniredis %s)", e, d, d.FixedIn)
+		}
+	default:
+		for _, e := range rec.errors {
+			t.Logf("known divergence (%s): %s", d.Reason, e)
+		}
+	}
+}
+
+// reporter is the part of *testing.T we use to report differences.
+type reporter interface {
+	Name() string
+	Helper()
+	Errorf(format string, args ...interface{})
+	Logf(format string, args ...interface{})
+}
+
+// recorder is a reporter which keeps everything, instead of failing a test.
+type recorder struct {
+	name   string
+	errors []string
+	logs   []string
+}
+
+func (r *recorder) Name() string { return r.name }
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Logf(format string, args ...interface{}) {
+	r.logs = append(r.logs, fmt.Sprintf(format, args...))
+}
+
+// commandLine is the command with its arguments, separated by spaces.
+func commandLine(p command) string {
+	parts := []string{p.cmd}
+	for _, a := range p.args {
+		parts = append(parts, string(argBytes(a)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// globRegexp compiles a pattern with '*' and '?' wildcards. Everything else
+// is literal.
+func globRegexp(pattern string) *regexp.Regexp {
+	re := "(?s)^"
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			re += ".*"
+		case '?':
+			re += "."
+		default:
+			re += regexp.QuoteMeta(string(r))
+		}
+	}
+	return regexp.MustCompile(re + "$")
+}
+
+var (
+	miniredisVersionOnce sync.Once
+	miniredisVersionV    string
+)
+
+// miniredisVersion is the version of miniredis we're built with: from
+// -miniredis-version, the module build info, or a git checkout in $GOPATH.
+// "" if we don't know.
+func miniredisVersion() string {
+	miniredisVersionOnce.Do(func() {
+		if v := *miniredisVersionFlag; v != "" {
+			miniredisVersionV = v
+			return
+		}
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			for _, m := range bi.Deps {
+				if m.Path == miniredisPkg || strings.HasPrefix(m.Path, miniredisPkg+"/") {
+					if m.Replace != nil {
+						miniredisVersionV = m.Replace.Version
+					} else {
+						miniredisVersionV = m.Version
+					}
+					return
+				}
+			}
+		}
+		// GOPATH: no build info, but maybe git knows
+		pkg, err := build.Import(miniredisPkg, "", build.FindOnly)
+		if err != nil {
+			return
+		}
+		out, err := exec.Command("git", "-C", pkg.Dir, "describe", "--tags", "--abbrev=0").Output()
+		if err != nil {
+			return
+		}
+		miniredisVersionV = strings.TrimSpace(string(out))
+	})
+	return miniredisVersionV
+}
@@ -1,82 +1,366 @@
 package main
 
-// Start a redis server in memory-only mode on a random port.
+// Start a redis server in memory-only mode on a random port, or on a unix
+// socket.
 
 import (
+	"bytes"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
-)
 
-const (
-	executable = "redis-server"
+	"github.com/alicebob/miniredis"
 )
 
-type ephemeral exec.Cmd
+var unixMode = flag.Bool("unix", false, "talk to redis-server over a unix socket, instead of TCP")
+
+type ephemeral struct {
+	cmd  *exec.Cmd
+	dir  string        // temp dir for the socket, if any
+	log  *logBuffer    // stdout and stderr
+	done chan struct{} // closed when the process is gone
+	err  error         // from Wait(), after done
+
+	closeOnce sync.Once
+}
+
+// Options are the non-default settings for a redis-server. The zero value
+// is the default config.
+type Options struct {
+	Binary               string // redis-server to run. Default is the first one we found.
+	Requirepass          string
+	Maxmemory            string // "100mb", &c.
+	MaxmemoryPolicy      string // "allkeys-lru", &c.
+	NotifyKeyspaceEvents string // "KEA", &c.
+	Databases            int
+	LuaTimeLimit         time.Duration
+	Hz                   int
+	RenameCommand        map[string]string // command -> new name. "" disables the command.
+	Unixsocket           string            // path. The TCP port is still there.
+	ProtectedMode        string            // "yes" or "no"
+	TLSCertFile          string            // with TLS the port is a tls-port
+	TLSKeyFile           string
+	TLSCACertFile        string
+	TLSAuthClients       string   // "yes", "no", or "optional"
+	Extra                []string // any other directives, one per line
+
+	tcp        bool        // TCP, even with -unix. Replication needs it.
+	clusterBus bool        // the port needs room for the cluster bus port
+	tlsClient  *tls.Config // how we connect, with TLS
+}
 
-// Redis starts a memory-only redis on a random port. Will panic if that
-// doesn't work.
+// config is the redis.conf snippet for the options.
+func (o Options) config() string {
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	if o.Requirepass != "" {
+		add("requirepass %s", o.Requirepass)
+	}
+	if o.Maxmemory != "" {
+		add("maxmemory %s", o.Maxmemory)
+	}
+	if o.MaxmemoryPolicy != "" {
+		add("maxmemory-policy %s", o.MaxmemoryPolicy)
+	}
+	if o.NotifyKeyspaceEvents != "" {
+		add("notify-keyspace-events %s", o.NotifyKeyspaceEvents)
+	}
+	if o.Databases != 0 {
+		add("databases %d", o.Databases)
+	}
+	if o.LuaTimeLimit != 0 {
+		add("lua-time-limit %d", o.LuaTimeLimit/time.Millisecond)
+	}
+	if o.Hz != 0 {
+		add("hz %d", o.Hz)
+	}
+	var renames []string
+	for c := range o.RenameCommand {
+		renames = append(renames, c)
+	}
+	sort.Strings(renames) // the config is the pool key
+	for _, c := range renames {
+		add("rename-command %s %q", c, o.RenameCommand[c])
+	}
+	if o.Unixsocket != "" {
+		add("unixsocket %s", o.Unixsocket)
+	}
+	if o.ProtectedMode != "" {
+		add("protected-mode %s", o.ProtectedMode)
+	}
+	if o.TLSCertFile != "" {
+		add("tls-cert-file %s", o.TLSCertFile)
+		add("tls-key-file %s", o.TLSKeyFile)
+		add("tls-ca-cert-file %s", o.TLSCACertFile)
+	}
+	if o.TLSAuthClients != "" {
+		add("tls-auth-clients %s", o.TLSAuthClients)
+	}
+	lines = append(lines, o.Extra...)
+	return strings.Join(lines, "\n")
+}
+
+// applyMiniredis sets up miniredis with the same intent, as far as miniredis
+// has an equivalent. Returns the options it doesn't have.
+func (o Options) applyMiniredis(m *miniredis.Miniredis) []string {
+	var missing []string
+	if o.Requirepass != "" {
+		m.RequireAuth(o.Requirepass)
+	}
+	for name, set := range map[string]bool{
+		"maxmemory":              o.Maxmemory != "",
+		"maxmemory-policy":       o.MaxmemoryPolicy != "",
+		"notify-keyspace-events": o.NotifyKeyspaceEvents != "",
+		"databases":              o.Databases != 0,
+		"lua-time-limit":         o.LuaTimeLimit != 0,
+		"hz":                     o.Hz != 0,
+		"rename-command":         len(o.RenameCommand) > 0,
+		"unixsocket":             o.Unixsocket != "",
+		"protected-mode":         o.ProtectedMode != "",
+		"extra":                  len(o.Extra) > 0,
+	} {
+		if set {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// pooled is false if we can't reset a server with these options.
+func (o Options) pooled() bool {
+	return len(o.RenameCommand) == 0 && o.Unixsocket == ""
+}
+
+// Redis gives a clean memory-only redis on a random port, from the pool.
 // Returns something which you'll have to Close(), and a string to give to Dial()
-func Redis() (*ephemeral, string) {
-	return runRedis("")
+func Redis() (*pooledRedis, string, error) {
+	return RedisWith(Options{})
 }
 
-// RedisAuth starts a memory-only redis on a random port. The redis has
+// RedisAuth gives a memory-only redis on a random port. The redis has
 // authentication enabled. See Redis()
-func RedisAuth(passwd string) (*ephemeral, string) {
-	return runRedis(fmt.Sprintf("requirepass %s", passwd))
+func RedisAuth(passwd string) (*pooledRedis, string, error) {
+	return RedisWith(Options{Requirepass: passwd})
+}
+
+// RedisWith gives a memory-only redis on a random port, with non-default
+// options. See Redis()
+func RedisWith(o Options) (*pooledRedis, string, error) {
+	if *tlsMode && o.TLSCertFile == "" {
+		p, err := sharedPKI()
+		if err != nil {
+			return nil, "", err
+		}
+		o = p.options(o, "yes")
+	}
+	return servers.get(o)
+}
+
+const (
+	// startTimeout is how long redis-server gets to accept connections.
+	startTimeout = time.Second
+	// portAttempts is how often we try a new port, when someone else took
+	// the one arbitraryPort() gave us.
+	portAttempts = 5
+)
+
+func runRedis(o Options) (*ephemeral, string, error) {
+	for i := 1; ; i++ {
+		e, addr, portInUse, err := startRedis(o)
+		if portInUse && i < portAttempts {
+			continue
+		}
+		return e, addr, err
+	}
 }
 
-func runRedis(extraConfig string) (*ephemeral, string) {
-	port := arbitraryPort()
+// startRedis starts a redis-server. portInUse is true if it couldn't bind,
+// worth another try.
+func startRedis(o Options) (_ *ephemeral, _ string, portInUse bool, _ error) {
+	e := &ephemeral{
+		log:  &logBuffer{},
+		done: make(chan struct{}),
+	}
+	var listen, addr string
+	useTLS := o.TLSCertFile != ""
+	if *unixMode && !o.tcp && !useTLS {
+		// no TCP at all, so no race for the port
+		addr = o.Unixsocket
+		if addr == "" {
+			dir, err := tempDir()
+			if err != nil {
+				return nil, "", false, err
+			}
+			e.dir = dir
+			addr = filepath.Join(dir, "redis.sock")
+		}
+		o.Unixsocket = ""
+		listen = fmt.Sprintf("port 0\nunixsocket %s\nunixsocketperm 700\n", addr)
+	} else {
+		maxPort := 65535
+		if o.clusterBus {
+			maxPort -= clusterBusOffset
+		}
+		port, err := arbitraryPortUpTo(maxPort)
+		if err != nil {
+			return nil, "", false, err
+		}
+		addr = fmt.Sprintf("127.0.0.1:%d", port)
+		listen = fmt.Sprintf("port %d\nbind 127.0.0.1\n", port)
+		if useTLS {
+			listen = fmt.Sprintf("port 0\ntls-port %d\nbind 127.0.0.1\n", port)
+			tlsClients.Store(addr, o.tlsClient)
+		}
+	}
 
+	executable := o.Binary
+	if executable == "" {
+		if bs, _ := findBinaries(); len(bs) > 0 {
+			executable = bs[0].path
+		} else {
+			executable = defaultBinary
+		}
+	}
+	dir, err := runDir()
+	if err != nil {
+		e.cleanup()
+		return nil, "", false, err
+	}
 	c := exec.Command(executable, "-")
+	// never in the repo, and dump.rdb goes to the run dir as well
+	c.Dir = dir
+	c.Stdout = e.log
+	c.Stderr = e.log
 	stdin, err := c.StdinPipe()
 	if err != nil {
-		panic(err)
+		e.cleanup()
+		return nil, "", false, err
 	}
-	fmt.Fprintf(stdin, "port %d\nbind 127.0.0.1\nappendonly no\n%s", port, extraConfig)
+	fmt.Fprintf(stdin, "%sdir %s\nappendonly no\n%s", listen, dir, o.config())
 	stdin.Close()
 	if err := c.Start(); err != nil {
-		panic(err)
+		e.cleanup()
+		return nil, "", false, fmt.Errorf("start %s: %s", executable, err)
 	}
-
-	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	e.cmd = c
+	register(e)
+	go func() {
+		e.err = c.Wait()
+		close(e.done)
+	}()
 
 	// Wait until the thing is ready
-	timeout := time.Now().Add(1 * time.Second)
+	timeout := time.Now().Add(startTimeout)
 	for time.Now().Before(timeout) {
-		conn, err := net.Dial("tcp", addr)
+		select {
+		case <-e.done:
+			e.cleanup()
+			// arbitraryPort() closes its listener before redis-server binds,
+			// so the port can be gone by now.
+			portInUse := strings.Contains(e.log.String(), "Address already in use")
+			return nil, "", portInUse, fmt.Errorf("%s stopped: %v. output:\n%s", executable, e.err, e.log)
+		default:
+		}
+		conn, err := net.Dial(network(addr), addr)
 		if err == nil {
 			conn.Close()
-			e := ephemeral(*c)
-			return &e, addr
+			return e, addr, false, nil
 		}
 		time.Sleep(1 * time.Millisecond)
 	}
-	panic(fmt.Sprintf("No connection on port %d", port))
+	e.Close()
+	return nil, "", false, fmt.Errorf("no connection on %s after %s. output:\n%s", addr, startTimeout, e.log)
 }
 
 func (e *ephemeral) Close() {
-	((*exec.Cmd)(e)).Process.Kill()
-	((*exec.Cmd)(e)).Wait()
+	e.closeOnce.Do(func() {
+		e.cmd.Process.Kill()
+		<-e.done
+		unregister(e)
+		e.cleanup()
+	})
+}
+
+func (e *ephemeral) cleanup() {
+	if e.dir != "" {
+		os.RemoveAll(e.dir)
+	}
+}
+
+// logBuffer keeps everything redis-server writes.
+type logBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+// Len is where the next write will go.
+func (l *logBuffer) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Len()
+}
+
+// since returns everything after offset `from`.
+func (l *logBuffer) since(from int) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return string(l.b.Bytes()[from:])
+}
+
+func (l *logBuffer) String() string {
+	return l.since(0)
+}
+
+// network is "unix" for socket paths, and "tcp" for everything else.
+func network(addr string) string {
+	if strings.HasPrefix(addr, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// arbitraryPortUpTo is arbitraryPort(), but only ports up to max.
+func arbitraryPortUpTo(max int) (int, error) {
+	for i := 0; i < 100; i++ {
+		port, err := arbitraryPort()
+		if err != nil || port <= max {
+			return port, err
+		}
+	}
+	return 0, fmt.Errorf("no free port up to %d", max)
 }
 
-// arbitraryPort returns a non-used port.
-func arbitraryPort() int {
+// arbitraryPort returns a port which isn't used right now. Someone else can
+// take it before we do, see runRedis().
+func arbitraryPort() (int, error) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
 	defer l.Close()
 	addr := l.Addr().String()
 	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	p, _ := strconv.Atoi(port)
-	return p
+	return strconv.Atoi(port)
 }
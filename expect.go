@@ -0,0 +1,167 @@
+package main
+
+// Expectations: what the replies should be, no matter what the other server
+// says.
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+)
+
+// expectation checks a single reply.
+type expectation interface {
+	check(v interface{}, err error) error
+}
+
+// expect adds expectations, which both servers need to meet.
+func (c command) expect(es ...expectation) command {
+	c.expectations = append(append([]expectation(nil), c.expectations...), es...)
+	return c
+}
+
+// is expects an exact value. Strings match both status and bulk replies, and
+// ints match integer replies.
+func is(v interface{}) expectation {
+	return isExpectation{normalizeExpected(v)}
+}
+
+type isExpectation struct {
+	want interface{}
+}
+
+func (e isExpectation) check(v interface{}, err error) error {
+	if err != nil {
+		return fmt.Errorf("expected %#v, got error %q", e.want, err)
+	}
+	if have := normalizeExpected(v); !reflect.DeepEqual(have, e.want) {
+		return fmt.Errorf("expected %#v, got %#v", e.want, have)
+	}
+	return nil
+}
+
+// normalizeExpected makes replies and expected values comparable: bulk and
+// status replies become strings, ints become int64s.
+func normalizeExpected(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case int:
+		return int64(v)
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, e := range v {
+			res[i] = normalizeExpected(e)
+		}
+		return res
+	case []string:
+		res := make([]interface{}, len(v))
+		for i, e := range v {
+			res[i] = e
+		}
+		return res
+	default:
+		return v
+	}
+}
+
+// between expects an integer reply in [min, max].
+func between(min, max int64) expectation {
+	return betweenExpectation{min, max}
+}
+
+type betweenExpectation struct {
+	min, max int64
+}
+
+func (e betweenExpectation) check(v interface{}, err error) error {
+	if err != nil {
+		return fmt.Errorf("expected an integer in [%d, %d], got error %q", e.min, e.max, err)
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return fmt.Errorf("expected an integer in [%d, %d], got %s %#v", e.min, e.max, replyType(v), v)
+	}
+	if n < e.min || n > e.max {
+		return fmt.Errorf("expected an integer in [%d, %d], got %d", e.min, e.max, n)
+	}
+	return nil
+}
+
+// length expects an array reply with n elements.
+func length(n int) expectation {
+	return lengthExpectation{n}
+}
+
+type lengthExpectation struct {
+	n int
+}
+
+func (e lengthExpectation) check(v interface{}, err error) error {
+	if err != nil {
+		return fmt.Errorf("expected an array with %d elements, got error %q", e.n, err)
+	}
+	vs, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected an array with %d elements, got %s %#v", e.n, replyType(v), v)
+	}
+	if len(vs) != e.n {
+		return fmt.Errorf("expected an array with %d elements, got %d", e.n, len(vs))
+	}
+	return nil
+}
+
+// matches expects a status or bulk reply, or an error message, which matches
+// the regexp.
+func matches(re string) expectation {
+	return matchesExpectation{regexp.MustCompile(re)}
+}
+
+type matchesExpectation struct {
+	re *regexp.Regexp
+}
+
+func (e matchesExpectation) check(v interface{}, err error) error {
+	var s string
+	switch {
+	case err != nil:
+		s = err.Error()
+	default:
+		switch v := v.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		default:
+			return fmt.Errorf("expected something matching %q, got %s %#v", e.re, replyType(v), v)
+		}
+	}
+	if !e.re.MatchString(s) {
+		return fmt.Errorf("expected something matching %q, got %q", e.re, s)
+	}
+	return nil
+}
+
+// checkExpectations reports which servers deviate from the expectations of a
+// command. If both do, either the expectation is wrong, or the real Redis is
+// not the version we think it is.
+func checkExpectations(t reporter, p command, vReal interface{}, errReal error, vMini interface{}, errMini error) {
+	t.Helper()
+	var eReal, eMini error
+	for _, e := range p.expectations {
+		if eReal == nil {
+			eReal = e.check(vReal, errReal)
+		}
+		if eMini == nil {
+			eMini = e.check(vMini, errMini)
+		}
+	}
+	switch {
+	case eReal != nil && eMini != nil:
+		t.Errorf("spec error: both servers deviate from spec. realredis: %s. miniredis: %s. case: %#v", eReal, eMini, p)
+	case eReal != nil:
+		t.Errorf("spec error: realredis deviates from spec: %s. case: %#v", eReal, p)
+	case eMini != nil:
+		t.Errorf("spec error: miniredis deviates from spec: %s. case: %#v", eMini, p)
+	}
+}
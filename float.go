@@ -0,0 +1,128 @@
+package main
+
+// Compare replies as floating point numbers.
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// tolerance is how far apart two floats may be. A difference within either
+// limit is fine.
+type tolerance struct {
+	ulps     uint64  // distance in units in the last place
+	relative float64 // relative to the largest absolute value
+}
+
+// defaultTolerance allows for the usual rounding noise, such as
+// "3.0000000000000004" vs "3".
+var defaultTolerance = tolerance{ulps: 4}
+
+func (tol tolerance) equal(a, b float64) bool {
+	if a == b || (math.IsNaN(a) && math.IsNaN(b)) {
+		return true
+	}
+	if math.IsInf(a, 0) || math.IsInf(b, 0) {
+		return false
+	}
+	if tol.ulps > 0 && ulpDistance(a, b) <= tol.ulps {
+		return true
+	}
+	if tol.relative > 0 && math.Abs(a-b) <= tol.relative*math.Max(math.Abs(a), math.Abs(b)) {
+		return true
+	}
+	return false
+}
+
+func (tol tolerance) String() string {
+	return fmt.Sprintf("%d ulps or %g relative", tol.ulps, tol.relative)
+}
+
+// ulpDistance is the number of representable floats between a and b.
+func ulpDistance(a, b float64) uint64 {
+	ia, ib := orderedBits(a), orderedBits(b)
+	if ia < ib {
+		ia, ib = ib, ia
+	}
+	return uint64(ia) - uint64(ib)
+}
+
+// orderedBits maps floats to integers which sort in the same order.
+func orderedBits(f float64) int64 {
+	i := int64(math.Float64bits(f))
+	if i < 0 {
+		i = math.MinInt64 - i
+	}
+	return i
+}
+
+// parseFloat reads a numeric reply as a float.
+func parseFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case []byte:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// floatDiff compares two replies, where everything which looks like a number
+// is compared within the tolerance. The reply types have to be the same: a
+// bulk "3" is not an integer 3. Returns an explanation if they differ,
+// and a list of formatting differences between numbers which are equal.
+func floatDiff(path string, a, b interface{}, tol tolerance) (string, []string) {
+	if av, ok := a.([]interface{}); ok {
+		bv, ok := b.([]interface{})
+		if !ok {
+			return fmt.Sprintf("%s: expected %s, got %s", path, replyType(a), replyType(b)), nil
+		}
+		if len(av) != len(bv) {
+			return fmt.Sprintf("%s: expected %d elements, got %d", path, len(av), len(bv)), nil
+		}
+		var warnings []string
+		for i := range av {
+			d, ws := floatDiff(fmt.Sprintf("%s[%d]", path, i), av[i], bv[i], tol)
+			warnings = append(warnings, ws...)
+			if d != "" {
+				return d, warnings
+			}
+		}
+		return "", warnings
+	}
+
+	if replyType(a) != replyType(b) {
+		return fmt.Sprintf("%s: expected %s %#v, got %s %#v", path, replyType(a), a, replyType(b), b), nil
+	}
+	fa, okA := parseFloat(a)
+	fb, okB := parseFloat(b)
+	if !okA || !okB {
+		if !reflect.DeepEqual(a, b) {
+			return fmt.Sprintf("%s: expected %#v, got %#v", path, a, b), nil
+		}
+		return "", nil
+	}
+	if !tol.equal(fa, fb) {
+		return fmt.Sprintf("%s: expected %v, got %v (outside %s)", path, fa, fb, tol), nil
+	}
+	if !reflect.DeepEqual(a, b) {
+		return "", []string{fmt.Sprintf("%s: expected %s, got %s", path, fmtNumber(a), fmtNumber(b))}
+	}
+	return "", nil
+}
+
+func fmtNumber(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return fmt.Sprintf("%q", v)
+	default:
+		return fmt.Sprintf("%#v", v)
+	}
+}
@@ -62,9 +62,9 @@ func TestRandom(t *testing.T) {
 }
 
 func TestUnknownCommand(t *testing.T) {
-	// Can't compare; we get a different message from redeo
 	testCommands(t,
-		fail("nosuch"), // redeo doesn't change the capitilization, Redis lowercases it.
+		fail("nosuch"),
+		fail("NoSuch"), // see known_divergences.json
 		succ("SET", "foo", "bar"),
 	)
 }
@@ -204,3 +204,39 @@ func TestProto(t *testing.T) {
 		succ("ECHO", strings.Repeat("X", 1<<24)),
 	)
 }
+
+func TestProtoRaw(t *testing.T) {
+	// status vs bulk vs integer replies
+	testRawCommands(t,
+		succ("SET", "foo", "OK"),
+		succ("GET", "foo"),
+		succ("PING"),
+		succ("ECHO", "OK"),
+		succ("TYPE", "foo"),
+		succ("EXISTS", "foo"),
+		succ("GET", "nosuch").expect(is(nil)),
+		succ("ECHO", ""),
+	)
+
+	// empty vs nil multibulks
+	testRawCommands(t,
+		succ("LRANGE", "nosuch", 0, -1),
+		succ("MGET", "nosuch"),
+		succ("HGETALL", "nosuch"),
+		succ("SCAN", 0),
+		succ("BRPOP", "nosuch", 1).took(time.Second),
+		succ("MULTI"),
+		succ("EXEC"),
+	)
+
+	// lua conversions
+	testRawCommands(t,
+		succ("EVAL", "return {ok = 'great'}", 0),
+		succ("EVAL", "return false", 0),
+		succ("EVAL", "return true", 0),
+		succ("EVAL", "return {}", 0),
+		succ("EVAL", "return {1,{}}", 0),
+		succ("EVAL", "return 3.99", 0),
+		fail("EVAL", "return {err = 'oops'}", 0),
+	)
+}
@@ -81,7 +81,10 @@ func TestHashGetall(t *testing.T) {
 	testCommands(t,
 		succ("HSET", "aap", "noot", "mies"),
 		succ("HSET", "aap", "vuur", "wim"),
-		succSorted("HGETALL", "aap"),
+		succ("HSET", "aap", "zus", "jet"),
+		succSortedPairs("HGETALL", "aap"),
+		succSorted("HKEYS", "aap"),
+		succSorted("HVALS", "aap"),
 
 		succ("HGETALL", "nosuch"),
 
@@ -132,6 +135,8 @@ func TestHashIncr(t *testing.T) {
 		succ("HINCRBYFLOAT", "aap", "noot", -13.1),
 		succ("HINCRBYFLOAT", "aap", "noot", 200),
 		succ("HGET", "aap", "noot"),
+		succFloat("HINCRBYFLOAT", "aap", "noot", 0.1),
+		succFloat("HGET", "aap", "noot"),
 
 		// Simple failure cases.
 		fail("HINCRBYFLOAT"),
@@ -160,9 +165,10 @@ func TestHscan(t *testing.T) {
 		succ("HSCAN", "h", 0, "MATCH", "anoth*", "COUNT", 100),
 		succ("HSCAN", "h", 0, "COUNT", 100, "MATCH", "anoth*"),
 
-		// Can't really test multiple keys.
-		// succ("SET", "key2", "value2"),
-		// succ("SCAN", 0),
+		// Multiple fields, in any order
+		succ("HSET", "h", "key2", "value3"),
+		succSortedPairsAt(1, "HSCAN", "h", 0),
+		succSortedPairsAt(1, "HSCAN", "h", 0, "COUNT", 100),
 
 		// Error cases
 		fail("HSCAN"),
@@ -172,7 +178,7 @@ func TestHscan(t *testing.T) {
 		fail("HSCAN", "h", 0, "MATCH"),
 		fail("HSCAN", "h", 0, "garbage"),
 		fail("HSCAN", "h", 0, "COUNT", 12, "MATCH", "foo", "garbage"),
-		// fail("HSCAN", "nosuch", 0, "COUNT", "garbage"),
+		fail("HSCAN", "nosuch", 0, "COUNT", "garbage"),
 		succ("SET", "str", "1"),
 		fail("HSCAN", "str", 0),
 	)
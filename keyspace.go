@@ -0,0 +1,314 @@
+package main
+
+// Dump and compare the complete keyspace of a server.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// snapshotDBs is how many databases we look at.
+	snapshotDBs = 16
+	// ttlTolerance is how much TTLs may differ. Miniredis doesn't count down
+	// TTLs by itself.
+	ttlTolerance = 2 * time.Second
+)
+
+// keyspace is everything in a server: db -> key -> entry.
+type keyspace map[int]map[string]keyEntry
+
+type keyEntry struct {
+	typ   string
+	value interface{}   // string, []string, or map[string]string
+	ttl   time.Duration // -1 if there is no TTL
+}
+
+// dumpKeyspace reads every key from every database, using a new connection.
+func dumpKeyspace(addr string) (keyspace, error) {
+	return dumpKeys(addr, nil)
+}
+
+// dumpKeys reads only the given keys: db -> keys. nil reads everything.
+func dumpKeys(addr string, only map[int][]string) (keyspace, error) {
+	c, err := dialRedis(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	ks := keyspace{}
+	for db := 0; db < snapshotDBs; db++ {
+		if only != nil && len(only[db]) == 0 {
+			continue
+		}
+		if _, err := c.Do("SELECT", db); err != nil {
+			if db > 0 {
+				// started with fewer databases
+				break
+			}
+			return nil, err
+		}
+		keys := only[db]
+		if only == nil {
+			if keys, err = scanKeys(c); err != nil {
+				return nil, err
+			}
+		}
+		for _, k := range keys {
+			e, err := dumpKey(c, k)
+			if err != nil {
+				return nil, fmt.Errorf("db %d key %q: %s", db, k, err)
+			}
+			if e.typ == "none" {
+				// expired while we were looking, or deleted
+				continue
+			}
+			if ks[db] == nil {
+				ks[db] = map[string]keyEntry{}
+			}
+			ks[db][k] = e
+		}
+	}
+	return ks, nil
+}
+
+// scanKeys returns all keys in the selected DB. SCAN can return a key more
+// than once, so we dedup.
+func scanKeys(c redis.Conn) ([]string, error) {
+	var (
+		seen   = map[string]bool{}
+		keys   []string
+		cursor = "0"
+	)
+	for {
+		res, err := redis.Values(c.Do("SCAN", cursor, "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		if len(res) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply: %#v", res)
+		}
+		cursor, err = redis.String(res[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		ks, err := redis.Strings(res[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range ks {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+func dumpKey(c redis.Conn, k string) (keyEntry, error) {
+	var (
+		e   keyEntry
+		err error
+	)
+	e.typ, err = redis.String(c.Do("TYPE", k))
+	if err != nil {
+		return e, err
+	}
+	switch e.typ {
+	case "none":
+		return e, nil
+	case "string":
+		e.value, err = redis.String(c.Do("GET", k))
+	case "list":
+		e.value, err = redis.Strings(c.Do("LRANGE", k, 0, -1))
+	case "set":
+		var m []string
+		m, err = redis.Strings(c.Do("SMEMBERS", k))
+		sort.Strings(m)
+		e.value = m
+	case "hash":
+		e.value, err = redis.StringMap(c.Do("HGETALL", k))
+	case "zset":
+		var m []string
+		m, err = redis.Strings(c.Do("ZRANGE", k, 0, -1, "WITHSCORES"))
+		e.value = canonicalScores(m)
+	default:
+		// unknown type, we only compare the type.
+	}
+	if err != nil {
+		return e, err
+	}
+
+	ttl, err := redis.Int64(c.Do("PTTL", k))
+	if err != nil {
+		return e, err
+	}
+	e.ttl = -1
+	if ttl >= 0 {
+		e.ttl = time.Duration(ttl) * time.Millisecond
+	}
+	return e, nil
+}
+
+// canonicalScores reformats the scores in a WITHSCORES reply, so we compare
+// the stored floats, not how they are formatted.
+func canonicalScores(m []string) []string {
+	for i := 1; i < len(m); i += 2 {
+		if f, err := strconv.ParseFloat(m[i], 64); err == nil {
+			m[i] = strconv.FormatFloat(f, 'g', -1, 64)
+		}
+	}
+	return m
+}
+
+// diffKeyspace returns a line per difference. Keys which only exist on one
+// side, but are about to expire, are ignored.
+func diffKeyspace(ksReal, ksMini keyspace) []string {
+	var diffs []string
+	for db := 0; db < snapshotDBs; db++ {
+		for _, k := range keyspaceKeys(db, ksReal, ksMini) {
+			diffs = append(diffs, diffEntry(db, k, ksReal, ksMini)...)
+		}
+	}
+	return diffs
+}
+
+// driftedKeys returns the keys which differ: db -> keys.
+func driftedKeys(ksReal, ksMini keyspace) map[int][]string {
+	drifted := map[int][]string{}
+	for db := 0; db < snapshotDBs; db++ {
+		for _, k := range keyspaceKeys(db, ksReal, ksMini) {
+			if len(diffEntry(db, k, ksReal, ksMini)) > 0 {
+				drifted[db] = append(drifted[db], k)
+			}
+		}
+	}
+	return drifted
+}
+
+// keyspaceKeys returns the keys in a db on either side, sorted.
+func keyspaceKeys(db int, ksReal, ksMini keyspace) []string {
+	keys := map[string]bool{}
+	for k := range ksReal[db] {
+		keys[k] = true
+	}
+	for k := range ksMini[db] {
+		keys[k] = true
+	}
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func diffEntry(db int, k string, ksReal, ksMini keyspace) []string {
+	eReal, okReal := ksReal[db][k]
+	eMini, okMini := ksMini[db][k]
+	switch {
+	case !okMini:
+		if !expiring(eReal) {
+			return []string{fmt.Sprintf("db %d key %q: only in realredis (%s)", db, k, eReal.typ)}
+		}
+	case !okReal:
+		if !expiring(eMini) {
+			return []string{fmt.Sprintf("db %d key %q: only in miniredis (%s)", db, k, eMini.typ)}
+		}
+	default:
+		return diffKey(db, k, eReal, eMini)
+	}
+	return nil
+}
+
+func diffKey(db int, k string, eReal, eMini keyEntry) []string {
+	if eReal.typ != eMini.typ {
+		return []string{
+			fmt.Sprintf("db %d key %q: type. realredis: %s miniredis: %s", db, k, eReal.typ, eMini.typ),
+		}
+	}
+	var diffs []string
+	if have, want := fmt.Sprintf("%q", eMini.value), fmt.Sprintf("%q", eReal.value); have != want {
+		diffs = append(diffs, fmt.Sprintf("db %d key %q: value. realredis: %s miniredis: %s", db, k, want, have))
+	}
+	if !ttlEqual(eReal.ttl, eMini.ttl) {
+		diffs = append(diffs, fmt.Sprintf("db %d key %q: ttl. realredis: %s miniredis: %s", db, k, fmtTTL(eReal.ttl), fmtTTL(eMini.ttl)))
+	}
+	return diffs
+}
+
+func expiring(e keyEntry) bool {
+	return e.ttl >= 0 && e.ttl <= ttlTolerance
+}
+
+func ttlEqual(a, b time.Duration) bool {
+	if a < 0 || b < 0 {
+		return a < 0 && b < 0
+	}
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+	return d <= ttlTolerance
+}
+
+func fmtTTL(d time.Duration) string {
+	if d < 0 {
+		return "none"
+	}
+	return d.String()
+}
+
+// compareKeyspace fails the test if the keyspaces of the servers differ.
+func compareKeyspace(t *testing.T, realAddr, miniAddr string) {
+	t.Helper()
+	diffs, err := keyspaceDiff(realAddr, miniAddr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reportKeyspace(t, diffs)
+}
+
+// reportKeyspace fails the test if there are any differences.
+func reportKeyspace(t *testing.T, diffs []string) {
+	t.Helper()
+	if len(diffs) > 0 {
+		msg := "keyspace error:"
+		for _, d := range diffs {
+			msg += "\n\t" + d
+		}
+		t.Error(msg)
+	}
+}
+
+// keyspaceDiff dumps both servers and returns the differences.
+func keyspaceDiff(realAddr, miniAddr string) ([]string, error) {
+	ksReal, ksMini, err := dumpBoth(realAddr, miniAddr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return diffKeyspace(ksReal, ksMini), nil
+}
+
+// dumpBoth is dumpKeys on both servers.
+func dumpBoth(realAddr, miniAddr string, only map[int][]string) (keyspace, keyspace, error) {
+	ksReal, err := dumpKeys(realAddr, only)
+	if err != nil {
+		return nil, nil, fmt.Errorf("realredis keyspace: %s", err)
+	}
+	ksMini, err := dumpKeys(miniAddr, only)
+	if err != nil {
+		return nil, nil, fmt.Errorf("miniredis keyspace: %s", err)
+	}
+	return ksReal, ksMini, nil
+}
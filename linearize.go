@@ -0,0 +1,475 @@
+package main
+
+// Linearizability checks of histories from concurrent clients.
+//
+// The checker is the Wing & Gong algorithm, with the memoization from Lowe's
+// "Testing for linearizability". Operations on different keys are checked
+// separately.
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/garyburd/redigo/redis"
+)
+
+// maxLinearizeOps is the most operations per key we check. The check is
+// exponential in the worst case.
+const maxLinearizeOps = 200
+
+// operation is a command from a history, with when it was sent and when the
+// reply came back.
+type operation struct {
+	client    int
+	cmd       command
+	out       string // the reply, see outString()
+	call, ret time.Duration
+}
+
+func (o operation) key() string {
+	if len(o.cmd.args) == 0 {
+		return ""
+	}
+	return fmt.Sprint(o.cmd.args[0])
+}
+
+func (o operation) String() string {
+	return fmt.Sprintf("client %d [%s, %s] %s -> %s", o.client, o.call, o.ret, commandLine(o.cmd), o.out)
+}
+
+// nilOut is how we write a nil reply.
+const nilOut = "(nil)"
+
+// outString makes a comparable string from a reply.
+func outString(v interface{}, err error) string {
+	if err != nil {
+		return "(error) " + err.Error()
+	}
+	switch v := v.(type) {
+	case nil:
+		return nilOut
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// model is a sequential specification of a data type. States are strings, so
+// we can memoize them.
+type model struct {
+	name string
+	init string
+	// step applies an operation, and returns whether the reply is right, and
+	// the new state.
+	step func(state string, o operation) (bool, string)
+}
+
+// noValue is the state of a key which doesn't exist.
+const noValue = "\x00"
+
+// registerModel is a string key with GET, SET, and INCR.
+var registerModel = model{
+	name: "register",
+	init: noValue,
+	step: func(state string, o operation) (bool, string) {
+		switch o.cmd.cmd {
+		case "GET":
+			if state == noValue {
+				return o.out == nilOut, state
+			}
+			return o.out == state, state
+		case "SET":
+			return o.out == "OK", fmt.Sprint(o.cmd.args[1])
+		case "INCR":
+			n := 0
+			if state != noValue {
+				var err error
+				if n, err = strconv.Atoi(state); err != nil {
+					return false, state
+				}
+			}
+			next := strconv.Itoa(n + 1)
+			return o.out == next, next
+		}
+		return false, state
+	},
+}
+
+// elemSep separates elements in list and set states.
+const elemSep = "\x1f"
+
+func splitElems(state string) []string {
+	if state == "" {
+		return nil
+	}
+	return strings.Split(state, elemSep)
+}
+
+// listModel is a list key with LPUSH and RPOP.
+var listModel = model{
+	name: "list",
+	init: "",
+	step: func(state string, o operation) (bool, string) {
+		l := splitElems(state)
+		switch o.cmd.cmd {
+		case "LPUSH":
+			l = append([]string{fmt.Sprint(o.cmd.args[1])}, l...)
+			return o.out == strconv.Itoa(len(l)), strings.Join(l, elemSep)
+		case "RPOP":
+			if len(l) == 0 {
+				return o.out == nilOut, state
+			}
+			last := l[len(l)-1]
+			return o.out == last, strings.Join(l[:len(l)-1], elemSep)
+		}
+		return false, state
+	},
+}
+
+// setModel is a set key with SADD, SREM, and SISMEMBER, one member at a time.
+var setModel = model{
+	name: "set",
+	init: "",
+	step: func(state string, o operation) (bool, string) {
+		members := splitElems(state)
+		m := fmt.Sprint(o.cmd.args[1])
+		i := sort.SearchStrings(members, m)
+		has := i < len(members) && members[i] == m
+		b := map[bool]string{true: "1", false: "0"}
+		switch o.cmd.cmd {
+		case "SISMEMBER":
+			return o.out == b[has], state
+		case "SADD":
+			if !has {
+				members = append(members[:i], append([]string{m}, members[i:]...)...)
+			}
+			return o.out == b[!has], strings.Join(members, elemSep)
+		case "SREM":
+			if has {
+				members = append(members[:i:i], members[i+1:]...)
+			}
+			return o.out == b[has], strings.Join(members, elemSep)
+		}
+		return false, state
+	},
+}
+
+// event is a call or a return in the history, in a doubly linked list.
+type event struct {
+	id         int // operation index
+	call       bool
+	match      *event // the return of a call
+	prev, next *event
+}
+
+// linearizable checks a history of a single key.
+func linearizable(m model, ops []operation) bool {
+	return linearizableWith(m, ops, nil)
+}
+
+// linearizableWith is linearizable, but operations which are optional may or
+// may not have happened.
+func linearizableWith(m model, ops []operation, optional []bool) bool {
+	if len(ops) == 0 {
+		return true
+	}
+	type timed struct {
+		t time.Duration
+		e *event
+	}
+	var evs []timed
+	for i, o := range ops {
+		call := &event{id: i, call: true}
+		ret := &event{id: i}
+		call.match = ret
+		evs = append(evs, timed{o.call, call}, timed{o.ret, ret})
+	}
+	// calls before returns at the same time, so they count as concurrent
+	sort.SliceStable(evs, func(i, j int) bool {
+		if evs[i].t != evs[j].t {
+			return evs[i].t < evs[j].t
+		}
+		return evs[i].e.call && !evs[j].e.call
+	})
+	head := &event{id: -1}
+	prev := head
+	for _, te := range evs {
+		prev.next = te.e
+		te.e.prev = prev
+		prev = te.e
+	}
+
+	lift := func(e *event) {
+		e.prev.next = e.next
+		if e.next != nil {
+			e.next.prev = e.prev
+		}
+		r := e.match
+		r.prev.next = r.next
+		if r.next != nil {
+			r.next.prev = r.prev
+		}
+	}
+	unlift := func(e *event) {
+		r := e.match
+		r.prev.next = r
+		if r.next != nil {
+			r.next.prev = r
+		}
+		e.prev.next = e
+		if e.next != nil {
+			e.next.prev = e
+		}
+	}
+	isOptional := func(id int) bool {
+		return optional != nil && optional[id]
+	}
+
+	type frame struct {
+		e       *event
+		state   string
+		skipped bool
+	}
+	var (
+		state      = m.init
+		linearized = make([]uint64, (len(ops)+63)/64)
+		seen       = map[string]bool{}
+		calls      []frame
+		e          = head.next
+	)
+	cacheKey := func(bits []uint64, s string) string {
+		b := make([]byte, 0, 8*len(bits)+len(s))
+		for _, w := range bits {
+			for i := uint(0); i < 64; i += 8 {
+				b = append(b, byte(w>>i))
+			}
+		}
+		return string(append(b, s...))
+	}
+	// try takes e out of the history, if we haven't been here before.
+	try := func(e *event, next string, skipped bool) bool {
+		linearized[e.id/64] |= 1 << uint(e.id%64)
+		k := cacheKey(linearized, next)
+		if seen[k] {
+			linearized[e.id/64] &^= 1 << uint(e.id%64)
+			return false
+		}
+		seen[k] = true
+		calls = append(calls, frame{e, state, skipped})
+		state = next
+		lift(e)
+		return true
+	}
+	for head.next != nil {
+		if e.call {
+			if ok, next := m.step(state, ops[e.id]); ok && try(e, next, false) {
+				e = head.next
+				continue
+			}
+			if isOptional(e.id) && try(e, state, true) {
+				e = head.next
+				continue
+			}
+			e = e.next
+			continue
+		}
+		// a return, and its call can't be linearized: backtrack
+		if len(calls) == 0 {
+			return false
+		}
+		f := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		state = f.state
+		linearized[f.e.id/64] &^= 1 << uint(f.e.id%64)
+		unlift(f.e)
+		if !f.skipped && isOptional(f.e.id) && try(f.e, state, true) {
+			// didn't work with it, try without it
+			e = head.next
+			continue
+		}
+		e = f.e.next
+	}
+	return true
+}
+
+// minimize finds a minimal set of operations from a non-linearizable history
+// which can't be linearized, whatever the other operations did. Dropping any
+// one of them makes the history linearizable.
+func minimize(m model, ops []operation) []operation {
+	optional := make([]bool, len(ops))
+	for i := range ops {
+		optional[i] = true
+		if linearizableWith(m, ops, optional) {
+			optional[i] = false
+		}
+	}
+	var core []operation
+	for i, o := range ops {
+		if !optional[i] {
+			core = append(core, o)
+		}
+	}
+	return core
+}
+
+// overlapping are the operations which aren't in core, but ran while the core
+// operations ran. Those are the usual suspects.
+func overlapping(ops, core []operation) []operation {
+	if len(core) == 0 {
+		return nil
+	}
+	from, until := core[0].call, core[0].ret
+	type id struct {
+		client    int
+		call, ret time.Duration
+	}
+	in := map[id]bool{}
+	for _, o := range core {
+		in[id{o.client, o.call, o.ret}] = true
+		if o.call < from {
+			from = o.call
+		}
+		if o.ret > until {
+			until = o.ret
+		}
+	}
+	var res []operation
+	for _, o := range ops {
+		if !in[id{o.client, o.call, o.ret}] && o.ret >= from && o.call <= until {
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// byKey splits a history per key.
+func byKey(ops []operation) map[string][]operation {
+	keys := map[string][]operation{}
+	for _, o := range ops {
+		keys[o.key()] = append(keys[o.key()], o)
+	}
+	return keys
+}
+
+// checkHistory reports the minimal non-linearizable sub-history of every key
+// which has one.
+func checkHistory(t *testing.T, server string, m model, ops []operation) {
+	t.Helper()
+	keys := byKey(ops)
+	var names []string
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		h := keys[k]
+		if len(h) > maxLinearizeOps {
+			// dropping operations can break a good history, so we don't
+			t.Errorf("%s: key %q: %d operations, can't check more than %d. Use more keys", server, k, len(h), maxLinearizeOps)
+			continue
+		}
+		if linearizable(m, h) {
+			continue
+		}
+		core := minimize(m, h)
+		msg := fmt.Sprintf("%s: history of key %q isn't linearizable as a %s. minimal history:", server, k, m.name)
+		for _, o := range core {
+			msg += "\n\t" + o.String()
+		}
+		if other := overlapping(h, core); len(other) > 0 {
+			msg += "\nwhich ran at the same time as:"
+			for _, o := range other {
+				msg += "\n\t" + o.String()
+			}
+		}
+		t.Error(msg)
+	}
+}
+
+// recordHistory runs `clients` connections with `n` commands each, and
+// records when every command was sent and its reply arrived.
+func recordHistory(addr string, clients, n int, seed int64, gen func(r *rand.Rand, client, i int) command) ([]operation, error) {
+	var (
+		mu    sync.Mutex
+		ops   []operation
+		wg    sync.WaitGroup
+		errs  = make(chan error, clients)
+		start = time.Now()
+	)
+	for c := 0; c < clients; c++ {
+		conn, err := dialRedis(addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		wg.Add(1)
+		go func(c int, conn redis.Conn) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed + int64(c)))
+			for i := 0; i < n; i++ {
+				p := gen(r, c, i)
+				call := time.Since(start)
+				v, err := conn.Do(p.cmd, p.args...)
+				ret := time.Since(start)
+				if _, ok := err.(redis.Error); err != nil && !ok {
+					// connection problem
+					errs <- err
+					return
+				}
+				mu.Lock()
+				ops = append(ops, operation{
+					client: c,
+					cmd:    p,
+					out:    outString(v, err),
+					call:   call,
+					ret:    ret,
+				})
+				mu.Unlock()
+			}
+		}(c, conn)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// testLinearizable records a history of concurrent clients against
+// miniredis, and checks it against the model. realredis is the control: if
+// its history isn't linearizable the model or the generator is wrong.
+func testLinearizable(t *testing.T, m model, clients, n int, gen func(r *rand.Rand, client, i int) command) {
+	t.Helper()
+	seed := *stressSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("seed: %d (use -stress-seed to repeat)", seed)
+
+	withBinaries(t, func(t *testing.T, bin string) {
+		sMini, err := miniredis.Run()
+		ok(t, err)
+		defer sMini.Close()
+		sReal, realAddr := realRedis(t, Options{Binary: bin})
+		defer sReal.Close()
+
+		hReal, err := recordHistory(realAddr, clients, n, seed, gen)
+		ok(t, err)
+		checkHistory(t, "realredis (control)", m, hReal)
+
+		hMini, err := recordHistory(miniredisAddr(t, sMini), clients, n, seed, gen)
+		ok(t, err)
+		checkHistory(t, "miniredis", m, hMini)
+	})
+}
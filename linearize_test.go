@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLinearizableRegister(t *testing.T) {
+	testLinearizable(t, registerModel, 8, 50, func(r *rand.Rand, client, i int) command {
+		key := fmt.Sprintf("reg:%d", r.Intn(4))
+		switch r.Intn(3) {
+		case 0:
+			return succ("GET", key)
+		case 1:
+			// integers only, so INCR always works
+			return succ("SET", key, r.Intn(10))
+		default:
+			return succ("INCR", key)
+		}
+	})
+}
+
+func TestLinearizableList(t *testing.T) {
+	testLinearizable(t, listModel, 8, 50, func(r *rand.Rand, client, i int) command {
+		key := fmt.Sprintf("list:%d", r.Intn(4))
+		if r.Intn(2) == 0 {
+			// unique values, so every pop has a single push
+			return succ("LPUSH", key, fmt.Sprintf("%d-%d", client, i))
+		}
+		return succ("RPOP", key)
+	})
+}
+
+func TestLinearizableSet(t *testing.T) {
+	testLinearizable(t, setModel, 8, 50, func(r *rand.Rand, client, i int) command {
+		key := fmt.Sprintf("set:%d", r.Intn(4))
+		m := r.Intn(5)
+		switch r.Intn(3) {
+		case 0:
+			return succ("SISMEMBER", key, m)
+		case 1:
+			return succ("SADD", key, m)
+		default:
+			return succ("SREM", key, m)
+		}
+	})
+}
+
+// the checker itself, with made up histories
+func TestLinearizeChecker(t *testing.T) {
+	ms := time.Millisecond
+	op := func(client int, call, ret time.Duration, out string, cmd string, args ...interface{}) operation {
+		return operation{client: client, cmd: succ(cmd, args...), out: out, call: call * ms, ret: ret * ms}
+	}
+
+	// concurrent SET and GET: both orders are fine
+	if !linearizable(registerModel, []operation{
+		op(0, 0, 10, "OK", "SET", "k", 1),
+		op(1, 5, 6, nilOut, "GET", "k"),
+		op(2, 7, 8, "1", "GET", "k"),
+	}) {
+		t.Error("concurrent history should be linearizable")
+	}
+
+	// a GET sees a value, and a later GET sees the old one
+	h := []operation{
+		op(0, 0, 1, "OK", "SET", "k", 1),
+		op(0, 4, 10, "OK", "SET", "k", 2),
+		op(1, 5, 6, "2", "GET", "k"),
+		op(2, 7, 8, "1", "GET", "k"),
+	}
+	if linearizable(registerModel, h) {
+		t.Fatal("stale read should not be linearizable")
+	}
+	// the two GETs can't be linearized, whatever the SETs did
+	if have, want := minimize(registerModel, h), h[2:]; !reflect.DeepEqual(have, want) {
+		t.Errorf("minimal history: have %v, want %v", have, want)
+	}
+	if have, want := overlapping(h, h[2:]), h[1:2]; !reflect.DeepEqual(have, want) {
+		t.Errorf("overlapping: have %v, want %v", have, want)
+	}
+
+	// the same element popped twice
+	h = []operation{
+		op(0, 0, 1, "1", "LPUSH", "l", "a"),
+		op(1, 2, 5, "a", "RPOP", "l"),
+		op(2, 3, 4, "a", "RPOP", "l"),
+	}
+	if linearizable(listModel, h) {
+		t.Error("double pop should not be linearizable")
+	}
+
+	// SADD says new, while it's already there
+	h = []operation{
+		op(0, 0, 1, "1", "SADD", "s", "a"),
+		op(1, 2, 3, "1", "SISMEMBER", "s", "a"),
+		op(1, 4, 5, "1", "SADD", "s", "a"),
+	}
+	if linearizable(setModel, h) {
+		t.Error("double add should not be linearizable")
+	}
+	if !linearizable(setModel, h[:2]) {
+		t.Error("add and check should be linearizable")
+	}
+}
@@ -5,8 +5,6 @@ package main
 import (
 	"testing"
 	"time"
-
-	"github.com/alicebob/miniredis"
 )
 
 func TestLPush(t *testing.T) {
@@ -309,32 +307,23 @@ func TestBrpop(t *testing.T) {
 }
 
 func TestBrpopMulti(t *testing.T) {
-	testMultiCommands(t,
-		func(r chan<- command, _ *miniredis.Miniredis) {
-			r <- succ("BRPOP", "key", 1)
-			r <- succ("BRPOP", "key", 1)
-			r <- succ("BRPOP", "key", 1)
-			r <- succ("BRPOP", "key", 1)
-			r <- succ("BRPOP", "key", 1) // will timeout
-		},
-		func(r chan<- command, _ *miniredis.Miniredis) {
-			r <- succ("LPUSH", "key", "aap", "noot", "mies")
-			time.Sleep(50 * time.Millisecond)
-			r <- succ("LPUSH", "key", "toon")
-		},
+	testSchedule(t,
+		blockOn(0, succ("BRPOP", "key", 1)),
+		on(1, succ("LPUSH", "key", "aap", "noot", "mies")),
+		on(0, succ("BRPOP", "key", 1)),
+		on(0, succ("BRPOP", "key", 1)),
+		blockOn(0, succ("BRPOP", "key", 1)),
+		on(1, succ("LPUSH", "key", "toon")),
+		blockOn(0, succ("BRPOP", "key", 1)), // will timeout
 	)
 }
 
 func TestBrpopTrans(t *testing.T) {
-	testMultiCommands(t,
-		func(r chan<- command, _ *miniredis.Miniredis) {
-			r <- succ("BRPOP", "key", 1)
-		},
-		func(r chan<- command, _ *miniredis.Miniredis) {
-			r <- succ("MULTI")
-			r <- succ("LPUSH", "key", "toon")
-			r <- succ("EXEC")
-		},
+	testSchedule(t,
+		blockOn(0, succ("BRPOP", "key", 1)),
+		on(1, succ("MULTI")),
+		on(1, succ("LPUSH", "key", "toon")),
+		on(1, succ("EXEC")),
 	)
 }
 
@@ -353,19 +342,14 @@ func TestBlpop(t *testing.T) {
 		fail("BLPOP", "key", -1),
 	)
 
-	testMultiCommands(t,
-		func(r chan<- command, _ *miniredis.Miniredis) {
-			r <- succ("BLPOP", "key", 1)
-			r <- succ("BLPOP", "key", 1)
-			r <- succ("BLPOP", "key", 1)
-			r <- succ("BLPOP", "key", 1)
-			r <- succ("BLPOP", "key", 1) // will timeout
-		},
-		func(r chan<- command, _ *miniredis.Miniredis) {
-			r <- succ("LPUSH", "key", "aap", "noot", "mies")
-			time.Sleep(10 * time.Millisecond)
-			r <- succ("LPUSH", "key", "toon")
-		},
+	testSchedule(t,
+		blockOn(0, succ("BLPOP", "key", 1)),
+		on(1, succ("LPUSH", "key", "aap", "noot", "mies")),
+		on(0, succ("BLPOP", "key", 1)),
+		on(0, succ("BLPOP", "key", 1)),
+		blockOn(0, succ("BLPOP", "key", 1)),
+		on(1, succ("LPUSH", "key", "toon")),
+		blockOn(0, succ("BLPOP", "key", 1)), // will timeout
 	)
 }
 
@@ -386,20 +370,168 @@ func TestBrpoplpush(t *testing.T) {
 		fail("BRPOPLPUSH", "from", "to", -1),
 		fail("BRPOPLPUSH", "from", "to", -1, "xxx"),
 	)
-	testMultiCommands(t,
-		func(r chan<- command, _ *miniredis.Miniredis) {
-			r <- succ("BRPOPLPUSH", "from", "to", 1)
-			r <- succ("BRPOPLPUSH", "from", "to", 1)
-			r <- succ("BRPOPLPUSH", "from", "to", 1)
-			r <- succ("BRPOPLPUSH", "from", "to", 1)
-			r <- succ("BRPOPLPUSH", "from", "to", 1) // will timeout
-		},
-		func(r chan<- command, _ *miniredis.Miniredis) {
-			r <- succ("LPUSH", "from", "aap", "noot", "mies")
-			time.Sleep(10 * time.Millisecond)
-			r <- succ("LPUSH", "from", "toon")
-			r <- succ("LRANGE", "from", 0, -1)
-			r <- succ("LRANGE", "to", 0, -1)
-		},
+	testSchedule(t,
+		blockOn(0, succ("BRPOPLPUSH", "from", "to", 1)),
+		on(1, succ("LPUSH", "from", "aap", "noot", "mies")),
+		on(0, succ("BRPOPLPUSH", "from", "to", 1)),
+		on(0, succ("BRPOPLPUSH", "from", "to", 1)),
+		blockOn(0, succ("BRPOPLPUSH", "from", "to", 1)),
+		on(1, succ("LPUSH", "from", "toon")),
+		on(1, succ("LRANGE", "from", 0, -1)),
+		on(1, succ("LRANGE", "to", 0, -1)),
+		blockOn(0, succ("BRPOPLPUSH", "from", "to", 1)), // will timeout
+		on(1, succ("LRANGE", "to", 0, -1)),
+	)
+}
+
+// Several clients blocked on the same keys. Redis serves them in the order in
+// which they blocked, miniredis in any order. What they popped together is the
+// same, see comparePopped(). Leftovers are deleted, so the keyspace doesn't
+// depend on who got what.
+func TestBlockingFairness(t *testing.T) {
+	t.Run("single push", func(t *testing.T) {
+		testSchedule(t,
+			blockOn(0, succ("BLPOP", "key", 1)),
+			blockOn(1, succ("BLPOP", "key", 1)),
+			blockOn(2, succ("BLPOP", "key", 1)),
+			on(3, succ("LPUSH", "key", "aap", "noot", "mies")),
+		)
+	})
+
+	// the timeouts tell the clients apart
+	t.Run("one push per element", func(t *testing.T) {
+		testSchedule(t,
+			blockOn(0, succ("BRPOP", "key", 1)),
+			blockOn(1, succ("BRPOP", "key", 2)),
+			blockOn(2, succ("BRPOP", "key", 3)),
+			on(3, succ("RPUSH", "key", "aap")),
+			on(3, succ("RPUSH", "key", "noot")),
+			on(3, succ("RPUSH", "key", "mies")),
+		)
+	})
+
+	// the last one times out
+	t.Run("not enough", func(t *testing.T) {
+		testSchedule(t,
+			blockOn(2, succ("BLPOP", "key", 1)),
+			blockOn(0, succ("BLPOP", "key", 1)),
+			blockOn(1, succ("BLPOP", "key", 1)),
+			on(3, succ("RPUSH", "key", "aap", "noot")),
+		)
+	})
+
+	t.Run("BLPOP and BRPOP", func(t *testing.T) {
+		testSchedule(t,
+			blockOn(0, succ("BRPOP", "key", 1)),
+			blockOn(1, succ("BLPOP", "key", 1)),
+			blockOn(2, succ("BRPOP", "key", 1)),
+			on(3, succ("RPUSH", "key", "aap", "noot", "mies")),
+		)
+	})
+
+	t.Run("several keys", func(t *testing.T) {
+		testSchedule(t,
+			blockOn(0, succ("BLPOP", "key1", "key2", 1)),
+			blockOn(1, succ("BLPOP", "key2", "key1", 1)),
+			blockOn(2, succ("BLPOP", "key2", 1)),
+			blockOn(3, succ("BLPOP", "key1", 1)),
+			// enough for everyone, so every order pops the same
+			on(4, succ("RPUSH", "key2", "aap", "noot", "mies")),
+			on(4, succ("RPUSH", "key1", "vuur")),
+			on(4, succ("LRANGE", "key1", 0, -1)),
+			on(4, succ("LRANGE", "key2", 0, -1)),
+			on(4, succLoosely("DEL", "key1", "key2")),
+		)
+	})
+
+	// pushes to several keys in a transaction
+	t.Run("transaction", func(t *testing.T) {
+		testSchedule(t,
+			blockOn(0, succ("BLPOP", "key1", 1)),
+			blockOn(1, succ("BLPOP", "key2", 1)),
+			blockOn(2, succ("BLPOP", "key1", "key2", 1)),
+			on(3, succ("MULTI")),
+			on(3, succ("RPUSH", "key2", "aap")),
+			on(3, succ("RPUSH", "key1", "noot", "mies")),
+			on(3, succ("EXEC")),
+			on(3, succ("LRANGE", "key1", 0, -1)),
+			on(3, succ("LRANGE", "key2", 0, -1)),
+			on(3, succLoosely("DEL", "key1", "key2")),
+		)
+	})
+}
+
+func TestBrpoplpushFairness(t *testing.T) {
+	t.Run("three clients", func(t *testing.T) {
+		testSchedule(t,
+			blockOn(0, succ("BRPOPLPUSH", "from", "to", 1)),
+			blockOn(1, succ("BRPOPLPUSH", "from", "to", 1)),
+			blockOn(2, succ("BRPOPLPUSH", "from", "to", 1)),
+			on(3, succ("LPUSH", "from", "aap", "noot", "mies")),
+			on(3, succ("LRANGE", "to", 0, -1)),
+			on(3, succ("DEL", "to")),
+		)
+	})
+
+	// the element moves on to the next waiter
+	t.Run("chain", func(t *testing.T) {
+		testSchedule(t,
+			blockOn(0, succ("BRPOPLPUSH", "from", "to", 1)),
+			blockOn(1, succ("BLPOP", "to", 1)),
+			blockOn(2, succ("BLPOP", "from", 1)),
+			on(3, succ("LPUSH", "from", "aap", "noot")),
+			on(3, succ("LRANGE", "to", 0, -1)),
+		)
+	})
+}
+
+// How long blocking commands block.
+func TestBlockingTimeouts(t *testing.T) {
+	ms := time.Millisecond
+	testCommands(t,
+		succ("BLPOP", "key", 1).took(time.Second),
+		succ("BRPOP", "key", 1).took(time.Second),
+		succ("BRPOPLPUSH", "from", "to", 1).took(time.Second),
+
+		// fractional timeouts are new in 6.0
+		succ("BLPOP", "key", 0.2).took(200*ms).since("6.0.0"),
+		succ("BRPOP", "key", 0.5).took(500*ms).since("6.0.0"),
+		succ("BRPOPLPUSH", "from", "to", 0.3).took(300*ms).since("6.0.0"),
+
+		// no need to wait
+		succ("RPUSH", "key", "aap", "noot"),
+		succ("BLPOP", "key", 0).took(0),
+		succ("BRPOP", "key", 0).took(0),
+
+		// blocking commands in a transaction don't block
+		succ("MULTI"),
+		succ("BLPOP", "key", 1),
+		succ("BRPOP", "key", 0),
+		succ("BRPOPLPUSH", "from", "to", 0),
+		succ("EXEC").took(0),
+	)
+
+	// 0 blocks until there is something
+	testSchedule(t,
+		blockOn(0, succ("BLPOP", "key", 0).took(300*ms)),
+		pause(300*ms),
+		on(1, succ("LPUSH", "key", "aap")),
+	)
+	testSchedule(t,
+		blockOn(0, succ("BRPOP", "key", 0).took(300*ms)),
+		pause(300*ms),
+		on(1, succ("LPUSH", "key", "aap")),
+	)
+	testSchedule(t,
+		blockOn(0, succ("BRPOPLPUSH", "from", "to", 0).took(300*ms)),
+		pause(300*ms),
+		on(1, succ("LPUSH", "from", "aap")),
+	)
+
+	// a push before the timeout
+	testSchedule(t,
+		blockOn(0, succ("BLPOP", "key", 1).took(200*ms)),
+		pause(200*ms),
+		on(1, succ("LPUSH", "key", "aap")),
 	)
 }
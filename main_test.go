@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if n := sweep(); n > 0 {
+		fmt.Printf("stopped %d redis-servers left by earlier runs\n", n)
+	}
+	killOnSignal()
+	code := m.Run()
+	servers.close()
+	closePKI()
+	killAll()
+	if s := skipSummary(); s != "" {
+		fmt.Println(s)
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,263 @@
+package main
+
+// A pool of redis-servers, so we don't start a new one for every test.
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var freshServers = flag.Bool("fresh", false, "start a new redis-server for every test, instead of reusing them")
+
+// cleanTimeout is how long we wait for killed clients to go away.
+const cleanTimeout = time.Second
+
+// servers are the idle servers, by their binary and extra config.
+var servers = &serverPool{
+	idle: map[string][]*pooledRedis{},
+}
+
+type serverPool struct {
+	mu     sync.Mutex
+	idle   map[string][]*pooledRedis
+	closed bool
+}
+
+// pooledRedis is a redis-server from the pool. Close() resets it and puts it
+// back.
+type pooledRedis struct {
+	e       *ephemeral
+	addr    string
+	extra   string            // binary and extra config it was started with
+	passwd  string            // for AUTH, if any
+	fresh   bool              // don't reuse
+	config  map[string]string // CONFIG GET * after start
+	version string            // redis_version, if we know it
+	since   int               // start of the log for the current user
+	output  string            // log for the current user, after Close()
+	closed  bool
+}
+
+// get returns an idle server, or starts a new one. Safe to use from parallel
+// tests.
+func (p *serverPool) get(o Options) (*pooledRedis, string, error) {
+	extra := o.Binary + "\n" + o.config()
+	p.mu.Lock()
+	if l := p.idle[extra]; len(l) > 0 {
+		s := l[len(l)-1]
+		p.idle[extra] = l[:len(l)-1]
+		p.mu.Unlock()
+		s = s.handout()
+		return s, s.addr, nil
+	}
+	p.mu.Unlock()
+
+	e, addr, err := runRedis(o)
+	if err != nil {
+		return nil, "", err
+	}
+	s := &pooledRedis{
+		e:      e,
+		addr:   addr,
+		extra:  extra,
+		passwd: o.Requirepass,
+		fresh:  !o.pooled(),
+	}
+	if c, err := s.dial(); err == nil {
+		s.version = serverVersion(c)
+		c.Close()
+	}
+	if s.fresh {
+		// CONFIG might be renamed, and we won't reset it anyway
+		s = s.handout()
+		return s, addr, nil
+	}
+	c, err := s.dial()
+	if err == nil {
+		s.config, err = configAll(c)
+		c.Close()
+	}
+	if err != nil {
+		e.Close()
+		return nil, "", fmt.Errorf("redis-server on %s: %s. output:\n%s", addr, err, e.log)
+	}
+	s = s.handout()
+	return s, addr, nil
+}
+
+// put resets the server and keeps it for the next test. If anything goes
+// wrong the server is stopped instead.
+func (p *serverPool) put(s *pooledRedis) {
+	if *freshServers || s.fresh {
+		s.e.Close()
+		return
+	}
+	if err := s.reset(); err != nil {
+		s.e.Close()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		s.e.Close()
+		return
+	}
+	p.idle[s.extra] = append(p.idle[s.extra], s)
+}
+
+// close stops all idle servers.
+func (p *serverPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, l := range p.idle {
+		for _, s := range l {
+			s.e.Close()
+		}
+	}
+	p.idle = map[string][]*pooledRedis{}
+	p.closed = true
+}
+
+// Close gives the server back to the pool.
+func (s *pooledRedis) Close() {
+	if s.closed {
+		return
+	}
+	s.output = s.e.log.since(s.since)
+	s.closed = true
+	servers.put(s)
+}
+
+// handout makes a new handle for the server, so a late Close() from an
+// earlier user can't give it back a second time.
+func (s *pooledRedis) handout() *pooledRedis {
+	h := *s
+	h.since = s.e.log.Len()
+	h.output = ""
+	h.closed = false
+	return &h
+}
+
+// Version is the redis_version of the server, or "".
+func (s *pooledRedis) Version() string {
+	return s.version
+}
+
+// Output is what redis-server logged since we got it. After Close() it's
+// what it logged until then.
+func (s *pooledRedis) Output() string {
+	if s.closed {
+		return s.output
+	}
+	return s.e.log.since(s.since)
+}
+
+func (s *pooledRedis) dial() (redis.Conn, error) {
+	return dialAuth(s.addr, s.passwd)
+}
+
+// reset makes the server look as if it was just started, and checks that it
+// did.
+func (s *pooledRedis) reset() error {
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// clients first, so nobody writes after the FLUSHALL
+	for _, typ := range []string{"normal", "pubsub"} {
+		if _, err := c.Do("CLIENT", "KILL", "TYPE", typ, "SKIPME", "yes"); err != nil {
+			return err
+		}
+	}
+	for _, cmd := range [][]interface{}{
+		{"FLUSHALL"},
+		{"SCRIPT", "FLUSH"},
+		{"CONFIG", "RESETSTAT"},
+	} {
+		if _, err := c.Do(cmd[0].(string), cmd[1:]...); err != nil {
+			return fmt.Errorf("%v: %s", cmd, err)
+		}
+	}
+	config, err := configAll(c)
+	if err != nil {
+		return err
+	}
+	for k, v := range s.config {
+		if config[k] != v {
+			if _, err := c.Do("CONFIG", "SET", k, v); err != nil {
+				return fmt.Errorf("CONFIG SET %s: %s", k, err)
+			}
+		}
+	}
+	return s.checkClean(c)
+}
+
+// checkClean returns an error if the server has any state left.
+func (s *pooledRedis) checkClean(c redis.Conn) error {
+	info, err := redis.String(c.Do("INFO", "keyspace"))
+	if err != nil {
+		return err
+	}
+	for _, l := range strings.Split(info, "\n") {
+		if strings.HasPrefix(l, "db") {
+			return fmt.Errorf("keys left: %s", strings.TrimSpace(l))
+		}
+	}
+
+	info, err = redis.String(c.Do("INFO", "memory"))
+	if err != nil {
+		return err
+	}
+	if n := infoField(info, "number_of_cached_scripts"); n != "" && n != "0" {
+		return fmt.Errorf("scripts left: %s", n)
+	}
+
+	config, err := configAll(c)
+	if err != nil {
+		return err
+	}
+	for k, v := range s.config {
+		if config[k] != v {
+			return fmt.Errorf("config %s is %q, not %q", k, config[k], v)
+		}
+	}
+
+	// killed clients can take a moment to disappear
+	timeout := time.Now().Add(cleanTimeout)
+	for {
+		list, err := redis.String(c.Do("CLIENT", "LIST"))
+		if err != nil {
+			return err
+		}
+		n := len(strings.Split(strings.TrimSpace(list), "\n"))
+		if n == 1 {
+			return nil
+		}
+		if time.Now().After(timeout) {
+			return fmt.Errorf("%d clients left", n-1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// configAll returns CONFIG GET *.
+func configAll(c redis.Conn) (map[string]string, error) {
+	return redis.StringMap(c.Do("CONFIG", "GET", "*"))
+}
+
+// infoField returns a field from an INFO reply, or "".
+func infoField(info, field string) string {
+	for _, l := range strings.Split(info, "\n") {
+		if strings.HasPrefix(l, field+":") {
+			return strings.TrimSpace(l[len(field)+1:])
+		}
+	}
+	return ""
+}
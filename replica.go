@@ -0,0 +1,159 @@
+package main
+
+// A real primary with a real replica.
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/garyburd/redigo/redis"
+)
+
+// syncTimeout is how long the replica gets for the initial sync.
+const syncTimeout = 5 * time.Second
+
+// replicaPair is a primary and a replica which follows it.
+type replicaPair struct {
+	primary, replica         *ephemeral
+	primaryAddr, replicaAddr string
+	version                  string // of the primary
+	passwd                   string // of both
+}
+
+// RedisReplicated starts a primary and a replica, and waits until the replica
+// is in sync. They always use TCP. Close() it when done.
+func RedisReplicated(o Options) (*replicaPair, error) {
+	o.tcp = true
+	primary, primaryAddr, err := runRedis(o)
+	if err != nil {
+		return nil, fmt.Errorf("primary: %s", err)
+	}
+	p := &replicaPair{
+		primary:     primary,
+		primaryAddr: primaryAddr,
+		passwd:      o.Requirepass,
+	}
+	if c, err := dialAuth(primaryAddr, o.Requirepass); err == nil {
+		p.version = serverVersion(c)
+		c.Close()
+	}
+
+	host, port, err := net.SplitHostPort(primaryAddr)
+	if err != nil {
+		primary.Close()
+		return nil, err
+	}
+	directive := "replicaof"
+	if p.version != "" && compareVersions(p.version, "5.0.0") < 0 {
+		directive = "slaveof"
+	}
+	ro := o
+	ro.Extra = append(append([]string(nil), o.Extra...), fmt.Sprintf("%s %s %s", directive, host, port))
+	if o.Requirepass != "" {
+		ro.Extra = append(ro.Extra, fmt.Sprintf("masterauth %s", o.Requirepass))
+	}
+	p.replica, p.replicaAddr, err = runRedis(ro)
+	if err != nil {
+		primary.Close()
+		return nil, fmt.Errorf("replica: %s", err)
+	}
+
+	if err := waitForSync(p.replicaAddr, o.Requirepass); err != nil {
+		err = fmt.Errorf("%s. primary output:\n%s\nreplica output:\n%s", err, p.primary.log, p.replica.log)
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *replicaPair) Close() {
+	p.replica.Close()
+	p.primary.Close()
+}
+
+func dialAuth(addr, passwd string) (redis.Conn, error) {
+	c, err := dialRedis(addr)
+	if err != nil {
+		return nil, err
+	}
+	if passwd != "" {
+		if _, err := c.Do("AUTH", passwd); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// waitForSync polls INFO replication on the replica until the link is up,
+// and the initial sync is done.
+func waitForSync(replicaAddr, passwd string) error {
+	c, err := dialAuth(replicaAddr, passwd)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	timeout := time.Now().Add(syncTimeout)
+	for {
+		info, err := redis.String(c.Do("INFO", "replication"))
+		if err != nil {
+			return err
+		}
+		if infoField(info, "master_link_status") == "up" &&
+			infoField(info, "master_sync_in_progress") == "0" {
+			return nil
+		}
+		if time.Now().After(timeout) {
+			return fmt.Errorf("replica not in sync after %s: %s", syncTimeout, info)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForReplica waits until the replica has everything written to the
+// primary so far.
+func waitForReplica(primaryAddr, passwd string) error {
+	c, err := dialAuth(primaryAddr, passwd)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	n, err := redis.Int(c.Do("WAIT", 1, int(syncTimeout/time.Millisecond)))
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return fmt.Errorf("WAIT: %d replicas, expected 1", n)
+	}
+	return nil
+}
+
+// like testCommands, but realredis is the primary of a primary/replica pair.
+// Afterwards both the primary and the replica need to have the same keyspace
+// as miniredis.
+func testReplicaCommands(t *testing.T, commands ...command) {
+	t.Helper()
+	withBinaries(t, func(t *testing.T, bin string) {
+		sMini, err := miniredis.Run()
+		ok(t, err)
+		defer sMini.Close()
+
+		pair, err := RedisReplicated(Options{Binary: bin})
+		if err != nil {
+			t.Fatalf("realredis: %s", err)
+		}
+		t.Cleanup(pair.Close)
+
+		runCommands(t, pair.version, pair.primaryAddr, sMini.Addr(), versionGate(t, pair.version, commands))
+		compareKeyspace(t, pair.primaryAddr, sMini.Addr())
+		if err := waitForReplica(pair.primaryAddr, pair.passwd); err != nil {
+			t.Errorf("realredis replica: %s", err)
+			return
+		}
+		compareKeyspace(t, pair.replicaAddr, sMini.Addr())
+	})
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReplication(t *testing.T) {
+	// realredis has a replica. Miniredis has no replication commands at
+	// all, see known_divergences.json.
+	testReplicaCommands(t,
+		succ("SET", "foo", "bar"),
+		succ("RPUSH", "list", "a", "b"),
+		succ("WAIT", 1, 1000),
+		succLoosely("ROLE"),
+		succLoosely("INFO", "replication"),
+		failClass("READONLY"), // only for cluster replicas
+		succ("GET", "foo"),
+	)
+}
@@ -0,0 +1,365 @@
+package main
+
+// Raw RESP connections. These don't decode replies, so we can compare the
+// exact frames from both servers.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/garyburd/redigo/redis"
+)
+
+// rawConn sends commands with our own encoder and returns the reply frames
+// unparsed.
+type rawConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRaw(addr string) (*rawConn, error) {
+	c, err := dialNet(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &rawConn{
+		conn: c,
+		r:    bufio.NewReader(c),
+	}, nil
+}
+
+func (c *rawConn) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends a command and returns the complete reply frame, exactly as the
+// server wrote it.
+func (c *rawConn) Do(cmd string, args ...interface{}) ([]byte, error) {
+	if _, err := c.conn.Write(encodeCommand(cmd, args)); err != nil {
+		return nil, err
+	}
+	return readFrame(c.r)
+}
+
+// encodeCommand makes a RESP array of bulk strings. Arguments are formatted
+// the same way redigo does it.
+func encodeCommand(cmd string, args []interface{}) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args)+1)
+	writeBulk(&b, []byte(cmd))
+	for _, a := range args {
+		writeBulk(&b, argBytes(a))
+	}
+	return b.Bytes()
+}
+
+func writeBulk(b *bytes.Buffer, v []byte) {
+	fmt.Fprintf(b, "$%d\r\n", len(v))
+	b.Write(v)
+	b.WriteString("\r\n")
+}
+
+func argBytes(a interface{}) []byte {
+	switch v := a.(type) {
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	case int:
+		return strconv.AppendInt(nil, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(nil, v, 10)
+	case float64:
+		return strconv.AppendFloat(nil, v, 'g', -1, 64)
+	case bool:
+		if v {
+			return []byte("1")
+		}
+		return []byte("0")
+	case nil:
+		return []byte{}
+	default:
+		return []byte(fmt.Sprint(v))
+	}
+}
+
+// readFrame reads a single reply, including all nested elements, and returns
+// the bytes as read.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid line: %q", line)
+	}
+	switch line[0] {
+	case '+', '-', ':':
+		return line, nil
+	case '$':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length: %q", line)
+		}
+		if n < 0 {
+			return line, nil
+		}
+		payload := make([]byte, n+2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		return append(line, payload...), nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length: %q", line)
+		}
+		frame := line
+		for i := 0; i < n; i++ {
+			elem, err := readFrame(r)
+			if err != nil {
+				return nil, err
+			}
+			frame = append(frame, elem...)
+		}
+		return frame, nil
+	default:
+		return nil, fmt.Errorf("invalid reply type: %q", line)
+	}
+}
+
+// decodeFrame parses a frame into what redigo's Do() returns: an error reply
+// is also the error, a status a string, a bulk a []byte, and nil bulks and arrays
+// are nil.
+func decodeFrame(f []byte) (interface{}, error) {
+	v, _, err := parseFrame(f)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := v.(redis.Error); ok {
+		return e, e
+	}
+	return v, nil
+}
+
+// parseFrame parses the first reply in f, and returns what's left.
+func parseFrame(f []byte) (interface{}, []byte, error) {
+	i := bytes.Index(f, []byte("\r\n"))
+	if len(f) < 1 || i < 1 {
+		return nil, nil, fmt.Errorf("invalid frame: %q", f)
+	}
+	line, rest := string(f[1:i]), f[i+2:]
+	switch f[0] {
+	case '+':
+		return line, rest, nil
+	case '-':
+		return redis.Error(line), rest, nil
+	case ':':
+		n, err := strconv.ParseInt(line, 10, 64)
+		return n, rest, err
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, rest, err
+		}
+		if len(rest) < n+2 {
+			return nil, nil, fmt.Errorf("short bulk: %q", f)
+		}
+		return rest[:n], rest[n+2:], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, rest, err
+		}
+		vs := make([]interface{}, n)
+		for j := range vs {
+			if vs[j], rest, err = parseFrame(rest); err != nil {
+				return nil, nil, err
+			}
+		}
+		return vs, rest, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid reply type: %q", f)
+	}
+}
+
+// errorFrame returns the message of an error frame.
+func errorFrame(f []byte) string {
+	return strings.TrimSuffix(string(f[1:]), "\r\n")
+}
+
+// frameDiff returns the offset of the first differing byte, or -1.
+func frameDiff(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return len(a)
+		}
+		return len(b)
+	}
+	return -1
+}
+
+// frameContext returns a few bytes around offset i, for error messages.
+func frameContext(f []byte, i int) string {
+	from, to := i-10, i+10
+	if from < 0 {
+		from = 0
+	}
+	if to > len(f) {
+		to = len(f)
+	}
+	if from > to {
+		from = to
+	}
+	return fmt.Sprintf("%q", f[from:to])
+}
+
+var frameTypes = map[byte]string{
+	'+': "status",
+	'-': "error",
+	':': "integer",
+	'$': "bulk",
+	'*': "multibulk",
+}
+
+// like testCommands, but compares the replies byte for byte.
+func testRawCommands(t *testing.T, commands ...command) {
+	t.Helper()
+	withBinaries(t, func(t *testing.T, bin string) {
+		sMini, err := miniredis.Run()
+		ok(t, err)
+		defer sMini.Close()
+
+		sReal, sRealAddr := realRedis(t, Options{Binary: bin})
+		defer sReal.Close()
+
+		miniAddr := miniredisAddr(t, sMini)
+		cMini, err := dialRaw(miniAddr)
+		ok(t, err)
+		defer cMini.Close()
+
+		cReal, err := dialRaw(sRealAddr)
+		ok(t, err)
+		defer cReal.Close()
+
+		tr := newTriage(t, sReal.Version(), sRealAddr, miniAddr)
+		defer tr.summary()
+		for _, c := range versionGate(t, sReal.Version(), commands) {
+			runRawCommand(t, tr, cMini, cReal, c)
+		}
+	})
+}
+
+// runRawCommand compares the reply frames of a single command. The error
+// flags of the command are used as usual, but 'unordered' and 'loosely' on a
+// successful command only compare the reply type. Expectations, floats, and
+// took() work on the decoded replies, as with testCommands.
+func runRawCommand(t *testing.T, tr *triage, cMini, cReal *rawConn, p command) {
+	t.Helper()
+	start := time.Now()
+	fReal, errReal := cReal.Do(p.cmd, p.args...)
+	dReal := time.Since(start)
+	if errReal != nil {
+		t.Errorf("realredis connection error: %s. case: %#v", errReal, p)
+		return
+	}
+	start = time.Now()
+	fMini, errMini := cMini.Do(p.cmd, p.args...)
+	dMini := time.Since(start)
+	if errMini != nil {
+		t.Errorf("miniredis connection error: %s. case: %#v", errMini, p)
+		return
+	}
+	tr.compare(t, p, func(r reporter) {
+		compareFrames(r, p, fReal, fMini)
+		checkTiming(r, "miniredis", p, dMini)
+	})
+	checkTiming(t, "realredis", p, dReal)
+}
+
+// compareFrames compares the reply frames of a single command.
+func compareFrames(t reporter, p command, fReal, fMini []byte) {
+	t.Helper()
+	if len(p.expectations) > 0 || p.float != nil {
+		vReal, errReal := decodeFrame(fReal)
+		vMini, errMini := decodeFrame(fMini)
+		if len(p.expectations) > 0 {
+			checkExpectations(t, p, vReal, errReal, vMini, errMini)
+		}
+		if p.float != nil && errReal == nil && errMini == nil {
+			// the numbers, not their formatting
+			d, warnings := floatDiff("reply", vReal, vMini, *p.float)
+			for _, w := range warnings {
+				t.Logf("warning: float formatting: %s. case: %#v", w, p)
+			}
+			if d != "" {
+				t.Errorf("value error: %s. case: %#v", d, p)
+			}
+			return
+		}
+	}
+
+	isErrReal, isErrMini := fReal[0] == '-', fMini[0] == '-'
+	if p.error {
+		if !isErrReal {
+			t.Errorf("got no error from realredis. case: %#v", p)
+			return
+		}
+		if !isErrMini {
+			t.Errorf("got no error from miniredis. case: %#v real error: %q", p, fReal)
+			return
+		}
+		if p.loosely {
+			return
+		}
+		if p.class {
+			compareErrorClass(t, p, errorFrame(fReal), errorFrame(fMini))
+			return
+		}
+		if p.errorSub != "" {
+			if !bytes.Contains(fReal, []byte(p.errorSub)) {
+				t.Errorf("realredis error error. expected: %q in %q case: %#v", p.errorSub, fReal, p)
+			}
+			if !bytes.Contains(fMini, []byte(p.errorSub)) {
+				t.Errorf("miniredis error error. expected: %q in %q case: %#v", p.errorSub, fMini, p)
+			}
+			return
+		}
+	} else {
+		if isErrReal {
+			t.Errorf("got an error from realredis: %q. case: %#v", fReal, p)
+			return
+		}
+		if isErrMini {
+			t.Errorf("got an error from miniredis: %q. case: %#v", fMini, p)
+			return
+		}
+		if p.unordered != ordered || p.loosely {
+			if fReal[0] != fMini[0] {
+				t.Errorf("type error. expected: %s got: %s case: %#v", frameTypes[fReal[0]], frameTypes[fMini[0]], p)
+			}
+			return
+		}
+	}
+
+	if i := frameDiff(fReal, fMini); i >= 0 {
+		msg := fmt.Sprintf("frame error at byte %d. expected: %s got: %s", i, frameContext(fReal, i), frameContext(fMini, i))
+		if i == 0 {
+			msg = fmt.Sprintf("frame error: expected a %s reply, got a %s reply. expected: %q got: %q", frameTypes[fReal[0]], frameTypes[fMini[0]], fReal, fMini)
+		}
+		t.Errorf("%s case: %#v", msg, p)
+	}
+}
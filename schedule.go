@@ -0,0 +1,381 @@
+package main
+
+// Run commands over multiple connections in a fixed order, without sleeps.
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/garyburd/redigo/redis"
+)
+
+const blockTimeout = 5 * time.Second
+
+// step is a single command in a schedule.
+type step struct {
+	conn  int // connection number, starting at 0
+	c     command
+	block bool          // the command is expected to block
+	pause time.Duration // not a command, but time passing
+}
+
+// on runs the command on connection `conn`, and waits for both replies.
+func on(conn int, c command) step {
+	return step{
+		conn: conn,
+		c:    c,
+	}
+}
+
+// blockOn sends the command on connection `conn`, and only waits until both
+// servers have it blocked (or replied). The replies are compared when they
+// arrive, at the latest before the next step on the same connection.
+func blockOn(conn int, c command) step {
+	return step{
+		conn:  conn,
+		c:     c,
+		block: true,
+	}
+}
+
+// pause lets time pass: realredis gets a sleep, miniredis a FastForward().
+// Waits for nothing which is blocked.
+func pause(d time.Duration) step {
+	return step{pause: d}
+}
+
+// testSchedule runs the steps in order, one at a time. Unlike
+// testMultiCommands there is no concurrency between connections, other than
+// the commands which are blocked.
+func testSchedule(t *testing.T, steps ...step) {
+	t.Helper()
+	withBinaries(t, func(t *testing.T, bin string) {
+		sMini, err := miniredis.Run()
+		ok(t, err)
+		defer sMini.Close()
+
+		miniAddr := miniredisAddr(t, sMini)
+		sReal, realAddr := realRedis(t, Options{Binary: bin})
+		defer sReal.Close()
+
+		ctrl, err := dialRedis(realAddr)
+		ok(t, err)
+		defer ctrl.Close()
+
+		n := 0
+		for _, s := range steps {
+			if s.conn >= n {
+				n = s.conn + 1
+			}
+		}
+		conns := make([]*schedConn, n)
+		for i := range conns {
+			c, err := dialSched(i, realAddr, miniAddr)
+			ok(t, err)
+			defer c.close()
+			conns[i] = c
+		}
+
+		tr := newTriage(t, sReal.Version(), realAddr, miniAddr)
+		defer tr.summary()
+		for _, s := range steps {
+			if s.pause > 0 {
+				time.Sleep(s.pause)
+				sMini.FastForward(s.pause)
+				continue
+			}
+			if !s.c.runsOn(sReal.Version()) {
+				skipCase(t, sReal.Version(), s.c)
+				continue
+			}
+			c := conns[s.conn]
+			c.wait(t, tr)
+			if !s.block {
+				if pendingMini(conns) == 0 {
+					runCommand(t, tr, c.mini, c.real, s.c)
+				} else {
+					runWaking(t, tr, sMini, c, conns, s.c)
+				}
+				continue
+			}
+
+			// one server at a time, so the order in which clients block is the
+			// same on both.
+			c.pending, c.waiting = s.c, true
+			c.realDone = c.do(c.real, s.c, &c.vReal, &c.errReal, &c.dReal)
+			if err := waitFor(c.realDone, func() (bool, error) {
+				return c.realBlocked(ctrl)
+			}); err != nil {
+				t.Fatalf("realredis: %s. case: %#v", err, s.c)
+			}
+
+			before := miniBlocked(sMini)
+			c.miniDone = c.do(c.mini, s.c, &c.vMini, &c.errMini, &c.dMini)
+			if err := waitFor(c.miniDone, func() (bool, error) {
+				return miniBlocked(sMini) > before, nil
+			}); err != nil {
+				t.Fatalf("miniredis: %s. case: %#v", err, s.c)
+			}
+		}
+		for _, c := range conns {
+			c.wait(t, tr)
+		}
+		comparePopped(t, conns)
+		compareKeyspace(t, realAddr, miniAddr)
+	})
+}
+
+// runWaking runs a command while miniredis has blocked commands, which the
+// command might wake up. miniredis Broadcasts to all of them at once, and which
+// one gets the lock first is up to the Go scheduler. So which client gets what
+// isn't fixed, see comparePopped(). We wait until they're all done or blocked
+// again, before we look at anything.
+func runWaking(t *testing.T, tr *triage, m *miniredis.Miniredis, c *schedConn, conns []*schedConn, p command) {
+	t.Helper()
+	settled := miniBlocked(m) - pendingMini(conns)
+
+	start := time.Now()
+	vReal, errReal := c.real.Do(p.cmd, p.args...)
+	dReal := time.Since(start)
+	start = time.Now()
+	vMini, errMini := c.mini.Do(p.cmd, p.args...)
+	dMini := time.Since(start)
+	if waitFor(nil, func() (bool, error) {
+		return miniBlocked(m)-pendingMini(conns) == settled, nil
+	}) != nil {
+		t.Fatalf("miniredis: woken commands didn't settle within %s. case: %#v", blockTimeout, p)
+	}
+	tr.compare(t, p, func(r reporter) {
+		compareReplies(r, p, vReal, errReal, vMini, errMini)
+		checkTiming(r, "miniredis", p, dMini)
+	})
+	checkTiming(t, "realredis", p, dReal)
+}
+
+// pendingMini counts the blocked commands miniredis didn't reply to yet.
+func pendingMini(conns []*schedConn) int {
+	n := 0
+	for _, c := range conns {
+		if !c.waiting {
+			continue
+		}
+		select {
+		case <-c.miniDone:
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// schedConn is a connection to both servers, with at most one outstanding
+// blocked command.
+type schedConn struct {
+	name               string
+	real, mini         redis.Conn
+	pending            command // a copy, steps are loop variables
+	waiting            bool    // pending is outstanding
+	realDone, miniDone chan struct{}
+	vReal, vMini       interface{}
+	errReal, errMini   error
+	dReal, dMini       time.Duration
+	popped             []poppedReply // the replies of the earlier blocked commands
+}
+
+// poppedReply is what a blocked command got from both servers.
+type poppedReply struct {
+	vReal, vMini     interface{}
+	errReal, errMini error
+}
+
+func dialSched(i int, realAddr, miniAddr string) (*schedConn, error) {
+	name := fmt.Sprintf("sched-%d", i)
+	cReal, err := dialRedis(realAddr)
+	if err != nil {
+		return nil, err
+	}
+	// Only on the real server; it's how we find the connection in CLIENT LIST.
+	if _, err := cReal.Do("CLIENT", "SETNAME", name); err != nil {
+		cReal.Close()
+		return nil, err
+	}
+	cMini, err := dialRedis(miniAddr)
+	if err != nil {
+		cReal.Close()
+		return nil, err
+	}
+	return &schedConn{
+		name: name,
+		real: cReal,
+		mini: cMini,
+	}, nil
+}
+
+func (c *schedConn) close() {
+	c.real.Close()
+	c.mini.Close()
+}
+
+// do runs a command in the background. The returned channel is closed when
+// the reply is stored.
+func (c *schedConn) do(conn redis.Conn, p command, v *interface{}, err *error, d *time.Duration) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		start := time.Now()
+		*v, *err = conn.Do(p.cmd, p.args...)
+		*d = time.Since(start)
+		close(done)
+	}()
+	return done
+}
+
+// wait waits for the outstanding blocked command, if any, and compares the
+// replies.
+func (c *schedConn) wait(t *testing.T, tr *triage) {
+	t.Helper()
+	if !c.waiting {
+		return
+	}
+	<-c.realDone
+	<-c.miniDone
+	p := c.pending
+	tr.compare(t, p, func(r reporter) {
+		compareReplies(r, p, c.vReal, c.errReal, c.vMini, c.errMini)
+		checkTiming(r, "miniredis", p, c.dMini)
+	})
+	checkTiming(t, "realredis", p, c.dReal)
+	c.popped = append(c.popped, poppedReply{c.vReal, c.vMini, c.errReal, c.errMini})
+	c.waiting = false
+}
+
+// comparePopped compares the replies of all blocked commands, no matter which
+// client got which. That's deterministic, unlike the order in which miniredis
+// serves its blocked clients.
+func comparePopped(t *testing.T, conns []*schedConn) {
+	t.Helper()
+	var real, mini []string
+	for _, c := range conns {
+		for _, p := range c.popped {
+			real = append(real, fmtPopped(p.vReal, p.errReal))
+			mini = append(mini, fmtPopped(p.vMini, p.errMini))
+		}
+	}
+	if len(real) < 2 {
+		return
+	}
+	sort.Strings(real)
+	sort.Strings(mini)
+	if !reflect.DeepEqual(real, mini) {
+		t.Errorf("popped error: the blocked commands got different replies. expected: %v got: %v", real, mini)
+	}
+}
+
+func fmtPopped(v interface{}, err error) string {
+	if err != nil {
+		return fmt.Sprintf("error %q", err)
+	}
+	return fmt.Sprintf("%#v", normalizeExpected(v))
+}
+
+// realBlocked checks the connection's flags in CLIENT LIST.
+func (c *schedConn) realBlocked(ctrl redis.Conn) (bool, error) {
+	list, err := redis.String(ctrl.Do("CLIENT", "LIST"))
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(list, "\n") {
+		f := clientFields(line)
+		if f["name"] == c.name {
+			return strings.Contains(f["flags"], "b"), nil
+		}
+	}
+	return false, nil
+}
+
+// clientFields parses a CLIENT LIST line.
+func clientFields(line string) map[string]string {
+	fields := map[string]string{}
+	for _, f := range strings.Fields(line) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	return fields
+}
+
+// miniBlocked counts the commands which are blocked in m. miniredis runs in
+// this process, so we look for its blocking handlers in a goroutine dump. The
+// handler is "miniredis.blocking(m, ...)", and it waits in a goroutine it
+// started, parked in sync.Cond.Wait(), without the lock. Other servers, such
+// as those of tests running in parallel, have a different m.
+func miniBlocked(m *miniredis.Miniredis) int {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	handler := fmt.Sprintf("alicebob/miniredis.blocking(%p", m)
+	var (
+		ours    = map[string]bool{} // goroutine ids of our handlers
+		waiters []string            // goroutine ids of the handlers of parked waiters
+	)
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		// "goroutine 14 [sync.Cond.Wait]:" or "[sync.Cond.Wait, 2 minutes]:".
+		// A woken goroutine has the same stack, but is "[runnable]".
+		header := strings.SplitN(g, "\n", 2)[0]
+		fields := strings.Fields(header)
+		if len(fields) < 2 {
+			continue
+		}
+		// arguments can have a "?" when the runtime isn't sure of them.
+		if strings.Contains(g, handler+",") || strings.Contains(g, handler+"?") {
+			ours[fields[1]] = true
+		}
+		if strings.Contains(header, "[sync.Cond.Wait") && strings.Contains(g, "alicebob/miniredis.blocking.func") {
+			// "created by github.com/alicebob/miniredis.blocking in goroutine 12"
+			if i := strings.LastIndex(g, "miniredis.blocking in goroutine "); i >= 0 {
+				waiters = append(waiters, strings.Fields(g[i+len("miniredis.blocking in goroutine "):])[0])
+			}
+		}
+	}
+	blocked := 0
+	for _, id := range waiters {
+		if ours[id] {
+			blocked++
+		}
+	}
+	return blocked
+}
+
+// waitFor polls until blocked() returns true, or until done is closed. done
+// can be nil.
+func waitFor(done <-chan struct{}, blocked func() (bool, error)) error {
+	timeout := time.Now().Add(blockTimeout)
+	for time.Now().Before(timeout) {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		b, err := blocked()
+		if err != nil {
+			return err
+		}
+		if b {
+			return nil
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	return fmt.Errorf("command didn't block within %s", blockTimeout)
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
 )
 
 func TestServer(t *testing.T) {
 	testCommands(t,
 		succ("SET", "foo", "bar"),
 		succ("SET", "baz", "bak"),
-		succ("DBSIZE"),
+		succ("DBSIZE").expect(is(2)),
 		succ("SELECT", 2),
-		succ("DBSIZE"),
+		succ("DBSIZE").expect(is(0)),
 		succ("SET", "baz", "bak"),
 
 		succ("SELECT", 0),
@@ -34,3 +39,47 @@ func TestServer(t *testing.T) {
 		fail("FLUSHALL", "ASYNC", "foo"),
 	)
 }
+
+func TestServerOptions(t *testing.T) {
+	// none of these change the replies of normal commands
+	testCommandsWith(t,
+		Options{
+			Maxmemory:            "100mb",
+			MaxmemoryPolicy:      "allkeys-lru",
+			NotifyKeyspaceEvents: "KEA",
+			Databases:            4,
+			LuaTimeLimit:         2 * time.Second,
+			Hz:                   50,
+			ProtectedMode:        "yes",
+			Extra:                []string{"slowlog-max-len 10"},
+		},
+		succ("SET", "foo", "bar"),
+		succ("SELECT", 3),
+		succ("SET", "foo", "baz"),
+		succ("GET", "foo"),
+		succ("EVAL", "return redis.call('GET', KEYS[1])", 1, "foo"),
+	)
+}
+
+func TestUnixSocket(t *testing.T) {
+	withBinaries(t, func(t *testing.T, bin string) {
+		// realredis over its socket, miniredis can only do TCP
+		dir, err := tempDir()
+		ok(t, err)
+		defer os.RemoveAll(dir)
+		sock := filepath.Join(dir, "redis.sock")
+
+		sMini, err := miniredis.Run()
+		ok(t, err)
+		defer sMini.Close()
+		sReal, _ := realRedis(t, Options{Binary: bin, Unixsocket: sock})
+		defer sReal.Close()
+
+		runCommands(t, sReal.Version(), sock, sMini.Addr(), []command{
+			succ("PING"),
+			succ("SET", "foo", "bar"),
+			succ("GET", "foo"),
+		})
+		compareKeyspace(t, sock, sMini.Addr())
+	})
+}
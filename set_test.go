@@ -150,6 +150,17 @@ func TestSetSpop(t *testing.T) {
 		// failure cases
 		fail("SPOP", "foo", "one"),
 	)
+
+	// Random pops mixed with counters. What's left in the set is random.
+	testCommandsNoSnapshot(t,
+		succ("SADD", "s", "aap", "noot", "mies", "vuur"),
+		succ("MULTI"),
+		succ("SPOP", "s", 2),
+		succ("INCR", "counter"),
+		succ("SCARD", "s"),
+		succLoosely("EXEC"),
+		succLoosely("EVAL", "return {redis.call('SPOP', KEYS[1]), redis.call('SCARD', KEYS[1])}", 1, "s"),
+	)
 }
 
 func TestSetSrandmember(t *testing.T) {
@@ -173,6 +184,19 @@ func TestSetSrandmember(t *testing.T) {
 		succ("SET", "str", "I am a string"),
 		fail("SRANDMEMBER", "str"),
 	)
+
+	// Random members mixed with other types
+	testCommands(t,
+		succ("SADD", "s", "aap", "noot", "mies"),
+		succLoosely("SRANDMEMBER", "s", -5),
+		succLoosely("EVAL", "return {redis.call('SRANDMEMBER', KEYS[1], -5), redis.call('SCARD', KEYS[1]), false}", 1, "s"),
+		succ("SET", "str", "I am a string"),
+		succ("MULTI"),
+		succ("SRANDMEMBER", "s"),
+		succ("INCR", "counter"),
+		succ("SMEMBERS", "str"),
+		succLoosely("EXEC"),
+	)
 }
 
 func TestSetSdiff(t *testing.T) {
@@ -260,6 +284,18 @@ func TestSetSunion(t *testing.T) {
 		fail("SUNIONSTORE", "res", "str", "s1"),
 		fail("SUNIONSTORE", "res", "s1", "str"),
 	)
+
+	testCommands(t,
+		succ("SADD", "s1", "aap", "noot", "mies"),
+		succ("SADD", "s2", "noot", "mies", "vuur"),
+		succ("SADD", "s3", "mies", "wim"),
+		succSorted("SUNION", "s1", "s2"),
+		succSorted("SUNION", "s1", "s2", "s3"),
+		succSorted("SINTER", "s1", "s2"),
+		succSorted("SDIFF", "s1", "s3"),
+		succ("SUNIONSTORE", "res", "s1", "s3"),
+		succSorted("SMEMBERS", "res"),
+	)
 }
 
 func TestSscan(t *testing.T) {
@@ -277,9 +313,10 @@ func TestSscan(t *testing.T) {
 		succ("SSCAN", "set", 0, "MATCH", "anoth*", "COUNT", 100),
 		succ("SSCAN", "set", 0, "COUNT", 100, "MATCH", "anoth*"),
 
-		// Can't really test multiple keys.
-		// succ("SET", "key2", "value2"),
-		// succ("SCAN", 0),
+		// Multiple members, in any order
+		succ("SADD", "set", "key2", "key3"),
+		succSortedAt(1, "SSCAN", "set", 0),
+		succSortedAt(1, "SSCAN", "set", 0, "COUNT", 100),
 
 		// Error cases
 		fail("SSCAN"),
@@ -460,6 +460,10 @@ func TestSortedSetIncyby(t *testing.T) {
 		succ("ZINCRBY", "z", 3, "m2"),
 		succ("ZINCRBY", "z", 3, "m2"),
 		succ("ZINCRBY", "z", 3, "m2"),
+		succFloatRel(1e-12, "ZINCRBY", "z", 0.1, "m3"),
+		succFloatRel(1e-12, "ZINCRBY", "z", 0.1, "m3"),
+		succFloatRel(1e-12, "ZINCRBY", "z", 0.1, "m3"),
+		succFloatULP(16, "ZSCORE", "z", "m3"),
 
 		// failure cases
 		fail("ZINCRBY"),
@@ -487,9 +491,10 @@ func TestZscan(t *testing.T) {
 		succ("ZSCAN", "h", 0, "MATCH", "anoth*", "COUNT", 100),
 		succ("ZSCAN", "h", 0, "COUNT", 100, "MATCH", "anoth*"),
 
-		// Can't really test multiple keys.
-		// succ("SET", "key2", "value2"),
-		// succ("SCAN", 0),
+		// Multiple members, in any order
+		succ("ZADD", "h", 2.0, "key2"),
+		succSortedPairsAt(1, "ZSCAN", "h", 0),
+		succSortedPairsAt(1, "ZSCAN", "h", 0, "COUNT", 100),
 
 		// Error cases
 		fail("ZSCAN"),
@@ -499,7 +504,7 @@ func TestZscan(t *testing.T) {
 		fail("ZSCAN", "h", 0, "MATCH"),
 		fail("ZSCAN", "h", 0, "garbage"),
 		fail("ZSCAN", "h", 0, "COUNT", 12, "MATCH", "foo", "garbage"),
-		// fail("ZSCAN", "nosuch", 0, "COUNT", "garbage"),
+		fail("ZSCAN", "nosuch", 0, "COUNT", "garbage"),
 		succ("SET", "str", "1"),
 		fail("ZSCAN", "str", 0),
 	)
@@ -518,6 +523,8 @@ func TestZunionstore(t *testing.T) {
 		succ("ZRANGE", "weighted", 0, -1, "WITHSCORES"),
 		succ("ZUNIONSTORE", "weighted2", 2, "h1", "h2", "WEIGHTS", "2", "-12"),
 		succ("ZRANGE", "weighted2", 0, -1, "WITHSCORES"),
+		succFloat("ZUNIONSTORE", "weighted3", 2, "h1", "h2", "WEIGHTS", "0.1", "0.2"),
+		succFloat("ZRANGE", "weighted3", 0, -1, "WITHSCORES"),
 
 		succ("ZUNIONSTORE", "amin", 2, "h1", "h2", "AGGREGATE", "min"),
 		succ("ZRANGE", "amin", 0, -1, "WITHSCORES"),
@@ -0,0 +1,112 @@
+package main
+
+// Many connections with random commutative commands at the same time. Only
+// the final keyspace is compared: the replies depend on the interleaving.
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+)
+
+var (
+	stressDuration = flag.Duration("stress-duration", time.Second, "how long stress tests run")
+	stressSeed     = flag.Int64("stress-seed", 0, "seed for stress tests. 0 is random")
+)
+
+const (
+	// stressKeys is the default number of keys per type. Few keys mean more
+	// contention.
+	stressKeys = 4
+	// maxStressErrors stops a connection after this many mismatches.
+	maxStressErrors = 3
+)
+
+// stressOp makes a random command, on one of `keys` keys. The order of the
+// commands from different connections must not matter for the final keyspace.
+type stressOp func(r *rand.Rand, conn, keys int) command
+
+// commutative ops. Every type has its own keys, so there are no WRONGTYPE
+// errors. Increments are integers, so float sums don't depend on the order.
+var stressOps = []stressOp{
+	func(r *rand.Rand, conn, keys int) command {
+		return succ("INCRBY", fmt.Sprintf("str:%d", r.Intn(keys)), r.Intn(100)-50)
+	},
+	func(r *rand.Rand, conn, keys int) command {
+		return succ("SADD", fmt.Sprintf("set:%d", r.Intn(keys)), r.Intn(20))
+	},
+	func(r *rand.Rand, conn, keys int) command {
+		return succ("HINCRBY", fmt.Sprintf("hash:%d", r.Intn(keys)), fmt.Sprintf("f%d", r.Intn(5)), r.Intn(10))
+	},
+	func(r *rand.Rand, conn, keys int) command {
+		return succ("ZINCRBY", fmt.Sprintf("zset:%d", r.Intn(keys)), r.Intn(10), fmt.Sprintf("m%d", r.Intn(5)))
+	},
+	func(r *rand.Rand, conn, keys int) command {
+		// a list per connection, lists don't commute
+		return succ("LPUSH", fmt.Sprintf("list:%d", conn), r.Intn(100))
+	},
+}
+
+// testStress runs `conns` connections to both servers, for -stress-duration,
+// with random commands from ops on `keys` keys per type. Every connection sends the same commands to
+// both servers. Afterwards the keyspaces need to be the same.
+func testStress(t *testing.T, conns, keys int, ops ...stressOp) {
+	t.Helper()
+	seed := *stressSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("stress seed: %d (use -stress-seed to repeat)", seed)
+
+	withBinaries(t, func(t *testing.T, bin string) {
+		sMini, err := miniredis.Run()
+		ok(t, err)
+		defer sMini.Close()
+		miniAddr := miniredisAddr(t, sMini)
+		sReal, realAddr := realRedis(t, Options{Binary: bin})
+		defer sReal.Close()
+
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			total int
+			until = time.Now().Add(*stressDuration)
+		)
+		for i := 0; i < conns; i++ {
+			cReal, err := dialRedis(realAddr)
+			ok(t, err)
+			defer cReal.Close()
+			cMini, err := dialRedis(miniAddr)
+			ok(t, err)
+			defer cMini.Close()
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed + int64(i)))
+				n, errs := 0, 0
+				for time.Now().Before(until) && errs < maxStressErrors {
+					p := ops[r.Intn(len(ops))](r, i, keys)
+					_, errReal := cReal.Do(p.cmd, p.args...)
+					_, errMini := cMini.Do(p.cmd, p.args...)
+					n++
+					if errReal != nil || errMini != nil {
+						t.Errorf("conn %d: got an error. realredis: %v miniredis: %v case: %#v", i, errReal, errMini, p)
+						errs++
+					}
+				}
+				mu.Lock()
+				total += n
+				mu.Unlock()
+			}(i)
+		}
+		wg.Wait()
+		t.Logf("%d commands on %d connections", total, conns)
+		compareKeyspace(t, realAddr, miniAddr)
+	})
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStress(t *testing.T) {
+	testStress(t, 8, stressKeys, stressOps...)
+}
+
+func TestStressSingleKey(t *testing.T) {
+	// everybody on the same counter
+	testStress(t, 16, 1, stressOps[0])
+}
@@ -1,25 +1,33 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"reflect"
-	"sort"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis"
 	"github.com/garyburd/redigo/redis"
 )
 
 type command struct {
-	cmd      string // 'GET', 'SET', &c.
-	args     []interface{}
-	error    bool   // Whether the command should return an error or not.
-	sort     bool   // Sort real redis's result. Used for 'keys'.
-	loosely  bool   // Don't compare values, only structure. (for random things)
-	errorSub string // Both errors need this substring
+	cmd       string // 'GET', 'SET', &c.
+	args      []interface{}
+	error     bool       // Whether the command should return an error or not.
+	unordered ordering   // Ignore the order of results. Used for 'keys' &c.
+	depth     int        // The array depth where `unordered` applies.
+	loosely   bool       // Don't compare values, only structure. (for random things)
+	float     *tolerance // Compare numbers as floats, within this tolerance.
+	errorSub  string     // Both errors need this substring
+	class     bool       // Only compare the class of the errors: ERR, WRONGTYPE, &c.
+	nilEmpty  bool       // An empty array is the same as nil. See emptyIsNil().
+
+	expectations []expectation  // Both replies need to match these. See expect().
+	minVersion   string         // Only for realredis versions since this one. See since().
+	maxVersion   string         // Only for realredis versions before this one. See before().
+	timing       *time.Duration // Both servers need to reply after about this long. See took().
 }
 
 func succ(cmd string, args ...interface{}) command {
@@ -30,12 +38,61 @@ func succ(cmd string, args ...interface{}) command {
 	}
 }
 
+// the result is a set of items
 func succSorted(cmd string, args ...interface{}) command {
+	return succSortedAt(0, cmd, args...)
+}
+
+// the result has a set of items at depth `depth`. A depth of 1 is the second
+// element of SSCAN, allDepths is every array in nested Lua tables.
+func succSortedAt(depth int, cmd string, args ...interface{}) command {
+	return command{
+		cmd:       cmd,
+		args:      args,
+		error:     false,
+		unordered: unorderedItems,
+		depth:     depth,
+	}
+}
+
+// the result is a set of field/value pairs, such as from HGETALL
+func succSortedPairs(cmd string, args ...interface{}) command {
+	return succSortedPairsAt(0, cmd, args...)
+}
+
+// the result has a set of field/value pairs at depth `depth`, such as HSCAN
+func succSortedPairsAt(depth int, cmd string, args ...interface{}) command {
+	return command{
+		cmd:       cmd,
+		args:      args,
+		error:     false,
+		unordered: unorderedPairs,
+		depth:     depth,
+	}
+}
+
+// compare numbers as floats, within the default tolerance. Formatting
+// differences are logged, but are not an error.
+func succFloat(cmd string, args ...interface{}) command {
+	return succFloatTolerance(defaultTolerance, cmd, args...)
+}
+
+// like succFloat, with a maximum distance in ULPs
+func succFloatULP(ulps uint64, cmd string, args ...interface{}) command {
+	return succFloatTolerance(tolerance{ulps: ulps}, cmd, args...)
+}
+
+// like succFloat, with a maximum relative difference
+func succFloatRel(rel float64, cmd string, args ...interface{}) command {
+	return succFloatTolerance(tolerance{relative: rel}, cmd, args...)
+}
+
+func succFloatTolerance(tol tolerance, cmd string, args ...interface{}) command {
 	return command{
 		cmd:   cmd,
 		args:  args,
 		error: false,
-		sort:  true,
+		float: &tol,
 	}
 }
 
@@ -66,6 +123,17 @@ func failWith(sub string, cmd string, args ...interface{}) command {
 	}
 }
 
+// expect an error of the same class (ERR, WRONGTYPE, ...). Different
+// messages are logged, but are not an error.
+func failClass(cmd string, args ...interface{}) command {
+	return command{
+		cmd:   cmd,
+		args:  args,
+		error: true,
+		class: true,
+	}
+}
+
 // only compare the error state, not the actual error message
 func failLoosely(cmd string, args ...interface{}) command {
 	return command{
@@ -86,80 +154,196 @@ func ok(tb testing.TB, err error) {
 
 func testCommands(t *testing.T, commands ...command) {
 	t.Helper()
-	sMini, err := miniredis.Run()
-	ok(t, err)
-	defer sMini.Close()
+	runTestCommands(t, true, commands)
+}
 
-	sReal, sRealAddr := Redis()
-	defer sReal.Close()
-	runCommands(t, sRealAddr, sMini.Addr(), commands)
+// like testCommands, but doesn't compare the keyspaces afterwards. For
+// sequences which leave random data behind.
+func testCommandsNoSnapshot(t *testing.T, commands ...command) {
+	t.Helper()
+	runTestCommands(t, false, commands)
+}
+
+func runTestCommands(t *testing.T, snapshot bool, commands []command) {
+	t.Helper()
+	runTestCommandsWith(t, Options{}, snapshot, commands)
 }
 
 // like testCommands, but multiple connections
 func testMultiCommands(t *testing.T, cs ...func(chan<- command, *miniredis.Miniredis)) {
 	t.Helper()
-	sMini, err := miniredis.Run()
-	ok(t, err)
-	defer sMini.Close()
+	runTestMultiCommands(t, true, cs)
+}
 
-	sReal, realAddr := Redis()
-	defer sReal.Close()
+// like testMultiCommands, but doesn't compare the keyspaces afterwards.
+func testMultiCommandsNoSnapshot(t *testing.T, cs ...func(chan<- command, *miniredis.Miniredis)) {
+	t.Helper()
+	runTestMultiCommands(t, false, cs)
+}
 
-	var wg sync.WaitGroup
-	for _, c := range cs {
-		// one connections per cs
-		cMini, err := redis.Dial("tcp", sMini.Addr())
+func runTestMultiCommands(t *testing.T, snapshot bool, cs []func(chan<- command, *miniredis.Miniredis)) {
+	t.Helper()
+	withBinaries(t, func(t *testing.T, bin string) {
+		sMini, err := miniredis.Run()
 		ok(t, err)
+		defer sMini.Close()
 
-		cReal, err := redis.Dial("tcp", realAddr)
-		ok(t, err)
+		miniAddr := miniredisAddr(t, sMini)
+		sReal, realAddr := realRedis(t, Options{Binary: bin})
+		defer sReal.Close()
+
+		var wg sync.WaitGroup
+		for _, c := range cs {
+			// one connections per cs
+			cMini, err := dialRedis(miniAddr)
+			ok(t, err)
+
+			cReal, err := dialRedis(realAddr)
+			ok(t, err)
 
-		wg.Add(1)
-		go func(c func(chan<- command, *miniredis.Miniredis)) {
-			defer wg.Done()
-			gen := make(chan command)
 			wg.Add(1)
-			go func() {
+			go func(c func(chan<- command, *miniredis.Miniredis)) {
 				defer wg.Done()
-				c(gen, sMini)
-				close(gen)
-			}()
-			for cm := range gen {
-				runCommand(t, cMini, cReal, cm)
-			}
-		}(c)
-	}
-	wg.Wait()
+				gen := make(chan command)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c(gen, sMini)
+					close(gen)
+				}()
+				for cm := range gen {
+					if !cm.runsOn(sReal.Version()) {
+						skipCase(t, sReal.Version(), cm)
+						continue
+					}
+					// no triage: the keyspace changes underneath us
+					runCommand(t, noTriage(sReal.Version()), cMini, cReal, cm)
+				}
+			}(c)
+		}
+		wg.Wait()
+		if snapshot {
+			compareKeyspace(t, realAddr, miniAddr)
+		}
+	})
 }
 
 func testAuthCommands(t *testing.T, passwd string, commands ...command) {
-	sMini, err := miniredis.Run()
-	ok(t, err)
-	defer sMini.Close()
-	sMini.RequireAuth(passwd)
+	t.Helper()
+	testCommandsWith(t, Options{Requirepass: passwd}, commands...)
+}
+
+// like testCommands, but with non-default options for both servers. Options
+// miniredis has no equivalent for are only used for realredis. With a
+// password there is no keyspace comparison.
+func testCommandsWith(t *testing.T, o Options, commands ...command) {
+	t.Helper()
+	runTestCommandsWith(t, o, o.Requirepass == "", commands)
+}
+
+func runTestCommandsWith(t *testing.T, o Options, snapshot bool, commands []command) {
+	t.Helper()
+	withBinaries(t, func(t *testing.T, bin string) {
+		o.Binary = bin
+		sMini, err := miniredis.Run()
+		ok(t, err)
+		defer sMini.Close()
+		if missing := o.applyMiniredis(sMini); len(missing) > 0 {
+			t.Logf("miniredis doesn't have: %s", strings.Join(missing, ", "))
+		}
+
+		sReal, sRealAddr := realRedis(t, o)
+		defer sReal.Close()
+		miniAddr := miniredisAddr(t, sMini)
+		runCommands(t, sReal.Version(), sRealAddr, miniAddr, versionGate(t, sReal.Version(), commands))
+		if snapshot {
+			compareKeyspace(t, sRealAddr, miniAddr)
+		}
+	})
+}
+
+// realRedis gives a realredis, or fails the test. Its output is logged if
+// the test fails.
+func realRedis(t *testing.T, o Options) (*pooledRedis, string) {
+	t.Helper()
+	s, addr, err := tryRealRedis(t, o)
+	if err != nil {
+		t.Fatalf("realredis: %s", err)
+	}
+	return s, addr
+}
 
-	sReal, sRealAddr := RedisAuth(passwd)
-	defer sReal.Close()
-	runCommands(t, sRealAddr, sMini.Addr(), commands)
+// tryRealRedis is realRedis, but leaves the error to the caller.
+func tryRealRedis(t *testing.T, o Options) (*pooledRedis, string, error) {
+	t.Helper()
+	s, addr, err := RedisWith(o)
+	if err != nil {
+		return nil, "", err
+	}
+	t.Cleanup(func() {
+		if out := s.Output(); t.Failed() && out != "" {
+			t.Logf("realredis output:\n%s", out)
+		}
+	})
+	// in case the test doesn't get to its own Close()
+	t.Cleanup(s.Close)
+	return s, addr, nil
 }
 
-func runCommands(t *testing.T, realAddr, miniAddr string, commands []command) {
+func runCommands(t *testing.T, version, realAddr, miniAddr string, commands []command) {
 	t.Helper()
-	cMini, err := redis.Dial("tcp", miniAddr)
+	cMini, err := dialRedis(miniAddr)
 	ok(t, err)
 
-	cReal, err := redis.Dial("tcp", realAddr)
+	cReal, err := dialRedis(realAddr)
 	ok(t, err)
 
+	tr := newTriage(t, version, realAddr, miniAddr)
+	defer tr.summary()
 	for _, c := range commands {
-		runCommand(t, cMini, cReal, c)
+		runCommand(t, tr, cMini, cReal, c)
 	}
 }
 
-func runCommand(t *testing.T, cMini, cReal redis.Conn, p command) {
+// runCommand runs a single command on both servers.
+func runCommand(t *testing.T, tr *triage, cMini, cReal redis.Conn, p command) {
 	t.Helper()
+	start := time.Now()
 	vReal, errReal := cReal.Do(p.cmd, p.args...)
+	dReal := time.Since(start)
+	start = time.Now()
 	vMini, errMini := cMini.Do(p.cmd, p.args...)
+	dMini := time.Since(start)
+	tr.compare(t, p, func(r reporter) {
+		compareReplies(r, p, vReal, errReal, vMini, errMini)
+		checkTiming(r, "miniredis", p, dMini)
+	})
+	checkTiming(t, "realredis", p, dReal)
+}
+
+// emptyIsNil compares an empty array reply as nil, for replies where both
+// mean the same thing, such as an aborted EXEC.
+func (c command) emptyIsNil() command {
+	c.nilEmpty = true
+	return c
+}
+
+func nilIfEmpty(v interface{}) interface{} {
+	if vs, ok := v.([]interface{}); ok && len(vs) == 0 {
+		return nil
+	}
+	return v
+}
+
+// compareReplies checks the replies of both servers for a single command.
+func compareReplies(t reporter, p command, vReal interface{}, errReal error, vMini interface{}, errMini error) {
+	t.Helper()
+	if p.nilEmpty {
+		vReal, vMini = nilIfEmpty(vReal), nilIfEmpty(vMini)
+	}
+	if len(p.expectations) > 0 {
+		checkExpectations(t, p, vReal, errReal, vMini, errMini)
+	}
 	if p.error {
 		if errReal == nil {
 			t.Errorf("got no error from realredis. case: %#v", p)
@@ -172,6 +356,10 @@ func runCommand(t *testing.T, cMini, cReal redis.Conn, p command) {
 		if p.loosely {
 			return
 		}
+		if p.class {
+			compareErrorClass(t, p, errReal.Error(), errMini.Error())
+			return
+		}
 	} else {
 		if errReal != nil {
 			t.Errorf("got an error from realredis: %v. case: %#v", errReal, p)
@@ -193,17 +381,37 @@ func runCommand(t *testing.T, cMini, cReal redis.Conn, p command) {
 	}
 
 	if !reflect.DeepEqual(errReal, errMini) {
-		t.Errorf("error error. expected: %#v got: %#v case: %#v", vReal, vMini, p)
+		if cReal, cMini := errorClass(errReal.Error()), errorClass(errMini.Error()); cReal != cMini {
+			t.Errorf("error class error. expected: %q got: %q. expected: %#v got: %#v case: %#v", cReal, cMini, errReal, errMini, p)
+			return
+		}
+		t.Errorf("error error. expected: %#v got: %#v case: %#v", errReal, errMini, p)
 		return
 	}
-	// Sort the strings.
-	if p.sort {
-		sort.Sort(BytesList(vReal.([]interface{})))
-		sort.Sort(BytesList(vMini.([]interface{})))
+	if p.unordered != ordered {
+		var err error
+		if vReal, err = sortReply(vReal, p.unordered, p.depth); err != nil {
+			t.Errorf("realredis sort error: %s. case: %#v", err, p)
+			return
+		}
+		if vMini, err = sortReply(vMini, p.unordered, p.depth); err != nil {
+			t.Errorf("miniredis sort error: %s. case: %#v", err, p)
+			return
+		}
+	}
+	if p.float != nil {
+		d, warnings := floatDiff("reply", vReal, vMini, *p.float)
+		for _, w := range warnings {
+			t.Logf("warning: float formatting: %s. case: %#v", w, p)
+		}
+		if d != "" {
+			t.Errorf("value error: %s. case: %#v", d, p)
+		}
+		return
 	}
 	if p.loosely {
-		if !looselyEqual(vReal, vMini) {
-			t.Errorf("value error. expected: %#v got: %#v case: %#v", vReal, vMini, p)
+		if d := looselyDiff("reply", vReal, vMini); d != "" {
+			t.Errorf("value error: %s. expected: %#v got: %#v case: %#v", d, vReal, vMini, p)
 			return
 		}
 	} else {
@@ -214,43 +422,85 @@ func runCommand(t *testing.T, cMini, cReal redis.Conn, p command) {
 	}
 }
 
-// BytesList implements the sort interface for things we know is a list of
-// bytes.
-type BytesList []interface{}
-
-func (b BytesList) Len() int {
-	return len(b)
-}
-func (b BytesList) Less(i, j int) bool {
-	return bytes.Compare(b[i].([]byte), b[j].([]byte)) < 0
+// errorClass is the first word of an error message, if that's in all caps.
+// "ERR", "WRONGTYPE", "NOSCRIPT", &c. Returns "" for errors without a class.
+func errorClass(msg string) string {
+	w := strings.SplitN(msg, " ", 2)[0]
+	if w == "" {
+		return ""
+	}
+	for _, r := range w {
+		if r < 'A' || r > 'Z' {
+			return ""
+		}
+	}
+	return w
 }
-func (b BytesList) Swap(i, j int) {
-	b[i], b[j] = b[j], b[i]
+
+// compareErrorClass fails if the error classes differ, and logs if only the
+// messages differ.
+func compareErrorClass(t reporter, p command, errReal, errMini string) {
+	t.Helper()
+	cReal, cMini := errorClass(errReal), errorClass(errMini)
+	if cReal != cMini {
+		t.Errorf("error class error. expected: %q got: %q. expected: %q got: %q case: %#v", cReal, cMini, errReal, errMini, p)
+		return
+	}
+	if errReal != errMini {
+		t.Logf("warning: error message drift. expected: %q got: %q case: %#v", errReal, errMini, p)
+	}
 }
 
-func looselyEqual(a, b interface{}) bool {
+// looselyDiff compares the structure of two replies, but not the values.
+// Returns an explanation if they differ, or "". `path` is the location of the
+// replies in the whole reply, for that explanation.
+func looselyDiff(path string, a, b interface{}) string {
 	switch av := a.(type) {
-	case string:
-		_, ok := b.(string)
-		return ok
-	case []byte:
-		_, ok := b.([]byte)
-		return ok
+	case nil:
+		if b != nil {
+			return fmt.Sprintf("%s: expected nil, got %s", path, replyType(b))
+		}
+		return ""
+	case int64, string, []byte, redis.Error:
+		if replyType(a) != replyType(b) {
+			return fmt.Sprintf("%s: expected %s, got %s", path, replyType(a), replyType(b))
+		}
+		return ""
 	case []interface{}:
 		bv, ok := b.([]interface{})
 		if !ok {
-			return false
+			return fmt.Sprintf("%s: expected %s, got %s", path, replyType(a), replyType(b))
 		}
 		if len(av) != len(bv) {
-			return false
+			return fmt.Sprintf("%s: expected %d elements, got %d", path, len(av), len(bv))
 		}
 		for i, v := range av {
-			if !looselyEqual(v, bv[i]) {
-				return false
+			if d := looselyDiff(fmt.Sprintf("%s[%d]", path, i), v, bv[i]); d != "" {
+				return d
 			}
 		}
-		return true
+		return ""
+	default:
+		return fmt.Sprintf("%s: unhandled reply type %T", path, a)
+	}
+}
+
+// replyType names the redigo reply types.
+func replyType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case int64:
+		return "integer"
+	case string:
+		return "status"
+	case []byte:
+		return "bulk"
+	case redis.Error:
+		return "error"
+	case []interface{}:
+		return "array"
 	default:
-		panic(fmt.Sprintf("unhandled case, got a %#v", a))
+		return fmt.Sprintf("%T", v)
 	}
 }
@@ -0,0 +1,31 @@
+package main
+
+// How long commands take to reply. For blocking commands and their timeouts.
+
+import (
+	"flag"
+	"time"
+)
+
+var timingTolerance = flag.Duration("timing-tolerance", 150*time.Millisecond, "how far off the reply times of took() commands can be")
+
+// took checks that both servers reply after about d. Commands which block
+// need blockOn() in a schedule, or a timeout.
+func (c command) took(d time.Duration) command {
+	c.timing = &d
+	return c
+}
+
+// checkTiming checks how long a server took to reply, for commands with
+// took(). realredis is checked outside of the known divergences: that's what
+// the test expects from Redis, not a difference between the servers.
+func checkTiming(t reporter, server string, p command, d time.Duration) {
+	t.Helper()
+	if p.timing == nil {
+		return
+	}
+	want := *p.timing
+	if off := d - want; off < -*timingTolerance || off > *timingTolerance {
+		t.Errorf("%s replied after %s, expected %s (±%s). case: %#v", server, d.Round(time.Millisecond), want, *timingTolerance, p)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+// TLS for both servers. This version of miniredis can't do TLS itself, so
+// it gets a TLS proxy in front of it.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/garyburd/redigo/redis"
+)
+
+var tlsMode = flag.Bool("tls", false, "talk to both servers over TLS")
+
+// tlsClients has the client config for every address which needs TLS.
+var tlsClients sync.Map // addr -> *tls.Config
+
+// dialRedis dials an address, with TLS if the address needs it.
+func dialRedis(addr string) (redis.Conn, error) {
+	if cfg, ok := tlsClients.Load(addr); ok {
+		return redis.Dial("tcp", addr, redis.DialUseTLS(true), redis.DialTLSConfig(cfg.(*tls.Config)))
+	}
+	return redis.Dial(network(addr), addr)
+}
+
+// dialNet is dialRedis for raw connections.
+func dialNet(addr string) (net.Conn, error) {
+	if cfg, ok := tlsClients.Load(addr); ok {
+		return tls.Dial("tcp", addr, cfg.(*tls.Config))
+	}
+	return net.Dial(network(addr), addr)
+}
+
+// pki is a throwaway CA, with a server and a client certificate from it.
+type pki struct {
+	dir                       string
+	caFile, certFile, keyFile string
+	ca                        *x509.CertPool
+	server, client            tls.Certificate
+}
+
+// newPKI makes a CA and certificates for 127.0.0.1, and writes the files
+// redis-server needs into a temp dir.
+func newPKI() (*pki, error) {
+	dir, err := tempDir()
+	if err != nil {
+		return nil, err
+	}
+	p := &pki{
+		dir:      dir,
+		caFile:   filepath.Join(dir, "ca.crt"),
+		certFile: filepath.Join(dir, "server.crt"),
+		keyFile:  filepath.Join(dir, "server.key"),
+		ca:       x509.NewCertPool(),
+	}
+	if err := p.generate(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *pki) generate() error {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "miniredis_vs_redis CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+	p.ca.AddCert(caCert)
+
+	issue := func(serial int64, usage x509.ExtKeyUsage) (tls.Certificate, []byte, []byte, error) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return tls.Certificate{}, nil, nil, err
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			DNSNames:     []string{"localhost"},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			return tls.Certificate{}, nil, nil, err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return tls.Certificate{}, nil, nil, err
+		}
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+		c, err := tls.X509KeyPair(certPEM, keyPEM)
+		return c, certPEM, keyPEM, err
+	}
+
+	var certPEM, keyPEM []byte
+	if p.server, certPEM, keyPEM, err = issue(2, x509.ExtKeyUsageServerAuth); err != nil {
+		return err
+	}
+	if p.client, _, _, err = issue(3, x509.ExtKeyUsageClientAuth); err != nil {
+		return err
+	}
+	for f, b := range map[string][]byte{
+		p.caFile:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		p.certFile: certPEM,
+		p.keyFile:  keyPEM,
+	} {
+		if err := os.WriteFile(f, b, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pki) Close() {
+	os.RemoveAll(p.dir)
+}
+
+// options sets up redis-server with our certificates. authClients is
+// "yes", "no", or "optional".
+func (p *pki) options(o Options, authClients string) Options {
+	o.TLSCertFile = p.certFile
+	o.TLSKeyFile = p.keyFile
+	o.TLSCACertFile = p.caFile
+	o.TLSAuthClients = authClients
+	o.tlsClient = p.clientConfig()
+	return o
+}
+
+// clientConfig trusts our CA, and has the client certificate.
+func (p *pki) clientConfig() *tls.Config {
+	return &tls.Config{
+		RootCAs:      p.ca,
+		Certificates: []tls.Certificate{p.client},
+	}
+}
+
+// serverConfig is what redis-server does with the same options.
+func (p *pki) serverConfig(authClients string) *tls.Config {
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{p.server},
+		ClientCAs:    p.ca,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	switch authClients {
+	case "no":
+		cfg.ClientAuth = tls.NoClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg
+}
+
+var (
+	runPKIOnce sync.Once
+	runPKI     *pki
+	runPKIErr  error
+)
+
+// sharedPKI is the PKI for the run. Servers with the same PKI can be reused.
+func sharedPKI() (*pki, error) {
+	runPKIOnce.Do(func() {
+		runPKI, runPKIErr = newPKI()
+	})
+	return runPKI, runPKIErr
+}
+
+// closePKI removes the files of sharedPKI(), if any.
+func closePKI() {
+	if runPKI != nil {
+		runPKI.Close()
+	}
+}
+
+// tlsProxy accepts TLS connections, and forwards them to miniredis.
+type tlsProxy struct {
+	l      net.Listener
+	target string
+	wg     sync.WaitGroup
+}
+
+func startTLSProxy(target string, cfg *tls.Config) (*tlsProxy, error) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		return nil, err
+	}
+	p := &tlsProxy{
+		l:      l,
+		target: target,
+	}
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+func (p *tlsProxy) Addr() string {
+	return p.l.Addr().String()
+}
+
+func (p *tlsProxy) serve() {
+	defer p.wg.Done()
+	for {
+		c, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		go p.forward(c)
+	}
+}
+
+func (p *tlsProxy) forward(c net.Conn) {
+	defer c.Close()
+	// handshake errors end up here, as they do in redis-server
+	if err := c.(*tls.Conn).Handshake(); err != nil {
+		return
+	}
+	back, err := net.Dial("tcp", p.target)
+	if err != nil {
+		return
+	}
+	defer back.Close()
+	go func() {
+		io.Copy(back, c)
+		back.Close()
+	}()
+	io.Copy(c, back)
+}
+
+func (p *tlsProxy) Close() {
+	p.l.Close()
+	p.wg.Wait()
+}
+
+// miniredisAddr is the address to use for miniredis. With -tls it's a TLS
+// proxy, which is closed at the end of the test.
+func miniredisAddr(t *testing.T, m *miniredis.Miniredis) string {
+	t.Helper()
+	if !*tlsMode {
+		return m.Addr()
+	}
+	p, err := sharedPKI()
+	ok(t, err)
+	addr, err := miniredisTLS(t, m, p, "yes", p.clientConfig())
+	ok(t, err)
+	return addr
+}
+
+// miniredisTLS starts a TLS proxy for miniredis. Connections to the returned
+// address use clientCfg.
+func miniredisTLS(t *testing.T, m *miniredis.Miniredis, p *pki, authClients string, clientCfg *tls.Config) (string, error) {
+	proxy, err := startTLSProxy(m.Addr(), p.serverConfig(authClients))
+	if err != nil {
+		return "", err
+	}
+	t.Cleanup(proxy.Close)
+	tlsClients.Store(proxy.Addr(), clientCfg)
+	return proxy.Addr(), nil
+}
+
+// like testCommands, but both servers use TLS, with client certificates
+// when authClients is "yes".
+func testTLSCommands(t *testing.T, authClients string, commands ...command) {
+	t.Helper()
+	p, err := sharedPKI()
+	ok(t, err)
+
+	withBinaries(t, func(t *testing.T, bin string) {
+		sMini, err := miniredis.Run()
+		ok(t, err)
+		defer sMini.Close()
+		miniAddr, err := miniredisTLS(t, sMini, p, authClients, p.clientConfig())
+		ok(t, err)
+
+		sReal, realAddr := realRedisTLS(t, p.options(Options{Binary: bin}, authClients))
+		defer sReal.Close()
+
+		runCommands(t, sReal.Version(), realAddr, miniAddr, versionGate(t, sReal.Version(), commands))
+		compareKeyspace(t, realAddr, miniAddr)
+	})
+}
+
+// realRedisTLS is realRedis, but skips the test if redis-server is built
+// without TLS.
+func realRedisTLS(t *testing.T, o Options) (*pooledRedis, string) {
+	t.Helper()
+	s, addr, err := tryRealRedis(t, o)
+	if err != nil {
+		if noTLS(err.Error()) {
+			t.Skipf("redis-server without TLS: %s", err)
+		}
+		t.Fatalf("realredis: %s", err)
+	}
+	return s, addr
+}
+
+// noTLS is true if the redis-server output says it can't do TLS.
+func noTLS(output string) bool {
+	// < 6, or 6.x built without BUILD_TLS: the tls-* directives don't exist
+	if strings.Contains(output, "Bad directive") && strings.Contains(output, "'tls-") {
+		return true
+	}
+	// 7.x built without BUILD_TLS
+	return strings.Contains(output, "connection listener of tls")
+}
+
+// handshakeCase is a client which connects to both servers.
+type handshakeCase struct {
+	name        string
+	authClients string                   // server side: "yes", "no", or "optional"
+	client      func(p *pki) *tls.Config // nil for no TLS at all
+	accept      bool                     // the PING works
+}
+
+// testTLSHandshakes checks that both servers accept or refuse the clients we
+// expect them to. The check is a PING.
+// miniredis itself can't do TLS, so for miniredis this checks that our proxy
+// does what tls-auth-clients does in redis-server. How the handshake fails
+// differs, and isn't compared: that's OpenSSL vs crypto/tls.
+func testTLSHandshakes(t *testing.T, cases ...handshakeCase) {
+	t.Helper()
+	p, err := sharedPKI()
+	ok(t, err)
+
+	withBinaries(t, func(t *testing.T, bin string) {
+		for _, c := range cases {
+			t.Run(c.name, func(t *testing.T) {
+				testTLSHandshake(t, p, bin, c)
+			})
+		}
+	})
+}
+
+// testTLSHandshake connects with a single client to both servers.
+func testTLSHandshake(t *testing.T, p *pki, bin string, c handshakeCase) {
+	t.Helper()
+	sMini, err := miniredis.Run()
+	ok(t, err)
+	defer sMini.Close()
+
+	var clientCfg *tls.Config
+	if c.client != nil {
+		clientCfg = c.client(p)
+	}
+	proxy, err := startTLSProxy(sMini.Addr(), p.serverConfig(c.authClients))
+	ok(t, err)
+	defer proxy.Close()
+
+	sReal, realAddr := realRedisTLS(t, p.options(Options{Binary: bin}, c.authClients))
+	defer sReal.Close()
+
+	for _, s := range []struct {
+		name, addr string
+	}{
+		{"realredis", realAddr},
+		{"miniredis", proxy.Addr()},
+	} {
+		err := pingWith(s.addr, clientCfg)
+		switch {
+		case c.accept && err != nil:
+			t.Errorf("handshake error: %s: %s refuses: %s", c.name, s.name, err)
+		case !c.accept && err == nil:
+			t.Errorf("handshake error: %s: %s accepts", c.name, s.name)
+		default:
+			t.Logf("%s: %s: %v", c.name, s.name, err)
+		}
+	}
+}
+
+// pingWith connects with the config (nil is plain TCP) and PINGs.
+func pingWith(addr string, cfg *tls.Config) error {
+	var opts []redis.DialOption
+	if cfg != nil {
+		opts = append(opts, redis.DialUseTLS(true), redis.DialTLSConfig(cfg))
+	}
+	opts = append(opts, redis.DialReadTimeout(time.Second))
+	c, err := redis.Dial("tcp", addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	v, err := redis.String(c.Do("PING"))
+	if err != nil {
+		return err
+	}
+	if v != "PONG" {
+		return fmt.Errorf("PING: %q", v)
+	}
+	return nil
+}
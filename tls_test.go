@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestTLS(t *testing.T) {
+	for _, auth := range []string{"yes", "no"} {
+		t.Run("auth-clients-"+auth, func(t *testing.T) {
+			testTLSCommands(t, auth,
+				succ("PING"),
+				succ("SET", "foo", "bar"),
+				succ("GET", "foo"),
+				succ("RPUSH", "list", "a", "b"),
+				succ("LRANGE", "list", 0, -1),
+			)
+		})
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	withCert := func(p *pki) *tls.Config { return p.clientConfig() }
+	withoutCert := func(p *pki) *tls.Config { return &tls.Config{RootCAs: p.ca} }
+	otherCA := func(p *pki) *tls.Config {
+		return &tls.Config{RootCAs: x509.NewCertPool(), Certificates: []tls.Certificate{p.client}}
+	}
+	testTLSHandshakes(t,
+		handshakeCase{"client cert", "yes", withCert, true},
+		handshakeCase{"no client cert", "yes", withoutCert, false},
+		handshakeCase{"optional client cert", "optional", withoutCert, true},
+		handshakeCase{"no client cert needed", "no", withoutCert, true},
+		handshakeCase{"unknown CA", "no", otherCA, false},
+		handshakeCase{"no TLS", "no", nil, false},
+	)
+}
@@ -0,0 +1,187 @@
+package main
+
+// Sort mismatches into first causes and their consequences.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+	"text/tabwriter"
+)
+
+var allErrors = flag.Bool("all-errors", false, "report consequential mismatches as errors, not only the first causes")
+
+const (
+	firstCause    = "first cause"
+	consequential = "consequential"
+)
+
+// triage keeps track of whether the servers still have the same data. A
+// mismatch while the keyspaces are equal is a first cause. A mismatch after
+// the keyspaces drifted apart is probably a consequence of an earlier one,
+// and is only logged, unless -all-errors is given.
+//
+// The whole keyspace is only dumped at a first cause. After that we only look
+// at the keys which drifted, until they're the same again.
+type triage struct {
+	t                  *testing.T
+	realAddr, miniAddr string
+	version            string // realredis
+	direct             bool   // no keyspace comparisons, see noTriage()
+	commands           int
+	diverged           bool             // the keyspaces differ
+	keyspace           []string         // the last keyspace differences
+	drifted            map[int][]string // the keys which differ: db -> keys
+	broken             bool             // we can't snapshot
+	rows               []triageRow
+}
+
+type triageRow struct {
+	n        int // command number, from 1
+	class    string
+	cmd      string
+	errors   []string
+	keyspace []string // keyspace differences after the command
+}
+
+func newTriage(t *testing.T, version, realAddr, miniAddr string) *triage {
+	return &triage{
+		t:        t,
+		realAddr: realAddr,
+		miniAddr: miniAddr,
+		version:  version,
+	}
+}
+
+// noTriage reports every mismatch directly, for when the keyspaces can't be
+// compared. It's safe to use from multiple goroutines.
+func noTriage(version string) *triage {
+	return &triage{
+		version: version,
+		direct:  true,
+	}
+}
+
+// compare runs the comparison for a command and reports the mismatches,
+// depending on the state the servers were in.
+func (tr *triage) compare(t *testing.T, p command, cmp func(reporter)) {
+	t.Helper()
+	if tr.direct {
+		compareKnown(t, tr.version, p, cmp)
+		return
+	}
+	tr.commands++
+	rec := &recorder{name: t.Name()}
+	compareKnown(rec, tr.version, p, cmp)
+	for _, l := range rec.logs {
+		t.Logf("%s", l)
+	}
+
+	if len(rec.errors) == 0 {
+		// maybe it got repaired by a DEL or a FLUSHALL
+		tr.recheck()
+		return
+	}
+
+	row := triageRow{
+		n:      tr.commands,
+		class:  firstCause,
+		cmd:    commandLine(p),
+		errors: rec.errors,
+	}
+	if tr.diverged {
+		row.class = consequential
+	}
+	for _, e := range rec.errors {
+		if row.class == firstCause || *allErrors {
+			t.Errorf("%s", e)
+		} else {
+			t.Logf("%s: %s", consequential, e)
+		}
+	}
+	if tr.diverged {
+		tr.recheck()
+	} else {
+		tr.snapshot()
+	}
+	if tr.diverged {
+		row.keyspace = tr.keyspace
+	}
+	tr.rows = append(tr.rows, row)
+}
+
+// snapshot compares the whole keyspaces. If that isn't possible every
+// mismatch counts as a first cause.
+func (tr *triage) snapshot() {
+	tr.diff(nil)
+}
+
+// recheck compares only the keys which drifted. When those are the same
+// again we take a full snapshot, something else might have drifted meanwhile.
+func (tr *triage) recheck() {
+	if !tr.diverged {
+		return
+	}
+	tr.diff(tr.drifted)
+	if !tr.diverged {
+		tr.snapshot()
+	}
+}
+
+func (tr *triage) diff(only map[int][]string) {
+	if tr.broken {
+		return
+	}
+	ksReal, ksMini, err := dumpBoth(tr.realAddr, tr.miniAddr, only)
+	if err != nil {
+		tr.t.Logf("can't compare keyspaces, all mismatches are first causes: %s", err)
+		tr.broken = true
+		tr.diverged = false
+		return
+	}
+	tr.keyspace = diffKeyspace(ksReal, ksMini)
+	tr.drifted = driftedKeys(ksReal, ksMini)
+	tr.diverged = len(tr.keyspace) > 0
+}
+
+// summary logs a table with all mismatches, if there were any.
+func (tr *triage) summary() {
+	tr.t.Helper()
+	if len(tr.rows) == 0 {
+		return
+	}
+	first := 0
+	for _, r := range tr.rows {
+		if r.class == firstCause {
+			first++
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "divergence summary: %d commands, %d mismatches, %d first causes\n", tr.commands, len(tr.rows), first)
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "#\tclass\terrors\tkeyspace diffs\tcommand\n")
+	for _, r := range tr.rows {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\n", r.n, r.class, len(r.errors), len(r.keyspace), shorten(r.cmd, 60))
+	}
+	w.Flush()
+	for _, r := range tr.rows {
+		if r.class != firstCause || len(r.keyspace) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "keyspace after #%d:\n", r.n)
+		for _, d := range r.keyspace {
+			fmt.Fprintf(&b, "\t%s\n", d)
+		}
+	}
+	tr.t.Log(strings.TrimSuffix(b.String(), "\n"))
+}
+
+func shorten(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"testing"
+	"time"
 )
 
 func TestTx(t *testing.T) {
@@ -141,3 +142,136 @@ func TestTx(t *testing.T) {
 		succ("EXEC"),
 	)
 }
+
+// A changed WATCHed key aborts the transaction. Only the reply of the aborted
+// EXEC is compared here, TestTxWatchConflicts doesn't look at it.
+func TestTxAborted(t *testing.T) {
+	testCommands(t,
+		succ("SET", "foo", "bar"),
+		succ("WATCH", "foo"),
+		succ("SET", "foo", "baz"),
+		succ("MULTI"),
+		succ("GET", "foo"),
+		succ("EXEC").expect(is(nil)), // see known_divergences.json
+		succ("GET", "foo"),
+	)
+}
+
+// One connection WATCHes "key", the other one touches it (or not). EXEC needs
+// to abort (nil) on both servers, or run on both. The cases are grouped by
+// what Redis does. An empty array is an aborted EXEC as well, see
+// TestTxAborted.
+func TestTxWatchConflicts(t *testing.T) {
+	var (
+		str    = on(1, succ("SET", "key", "value"))
+		number = on(1, succ("SET", "key", 1))
+		hash   = on(1, succ("HSET", "key", "field", "value"))
+		list   = on(1, succ("RPUSH", "key", "a", "b"))
+		set    = on(1, succ("SADD", "key", "a"))
+		zset   = on(1, succ("ZADD", "key", 1, "a"))
+		db1    = on(1, succ("SELECT", 1))
+	)
+	touch := func(cs ...command) []step {
+		var steps []step
+		for _, c := range cs {
+			steps = append(steps, on(1, c))
+		}
+		return steps
+	}
+
+	cases := []struct {
+		name  string
+		abort bool   // what Redis does with the EXEC
+		setup []step // before the WATCH
+		touch []step // after the WATCH, before the MULTI
+	}{
+		{"nothing", false, []step{str}, nil},
+		{"read", false, []step{str}, touch(succ("GET", "key"), succ("TYPE", "key"))},
+		{"other key", false, []step{str}, touch(succ("SET", "other", "value"))},
+
+		// strings
+		{"SET", true, []step{str}, touch(succ("SET", "key", "new"))},
+		{"SET new key", true, nil, touch(succ("SET", "key", "new"))},
+		{"SET same value", true, []step{str}, touch(succ("SET", "key", "value"))},
+		{"SETNX existing", false, []step{str}, touch(succ("SETNX", "key", "new"))},
+		{"APPEND", true, []step{str}, touch(succ("APPEND", "key", "more"))},
+		{"INCR", true, []step{number}, touch(succ("INCR", "key"))},
+		{"SETRANGE", true, []step{str}, touch(succ("SETRANGE", "key", 1, "x"))},
+
+		// hashes
+		{"HSET", true, []step{hash}, touch(succ("HSET", "key", "field", "new"))},
+		{"HDEL", true, []step{hash}, touch(succ("HDEL", "key", "field"))},
+		{"HDEL nosuch", false, []step{hash}, touch(succ("HDEL", "key", "nosuch"))},
+		{"HINCRBY", true, []step{hash}, touch(succ("HINCRBY", "key", "other", 1))},
+
+		// lists
+		{"LPUSH", true, []step{list}, touch(succ("LPUSH", "key", "c"))},
+		{"RPOP", true, []step{list}, touch(succ("RPOP", "key"))},
+		{"LSET", true, []step{list}, touch(succ("LSET", "key", 0, "c"))},
+		{"LREM nosuch", false, []step{list}, touch(succ("LREM", "key", 0, "nosuch"))},
+		{"LPUSHX nosuch", false, nil, touch(succ("LPUSHX", "key", "a"))},
+
+		// sets
+		{"SADD", true, []step{set}, touch(succ("SADD", "key", "b"))},
+		{"SADD existing", false, []step{set}, touch(succ("SADD", "key", "a"))},
+		{"SREM", true, []step{set}, touch(succ("SREM", "key", "a"))},
+		{"SREM nosuch", false, []step{set}, touch(succ("SREM", "key", "nosuch"))},
+
+		// sorted sets
+		{"ZADD", true, []step{zset}, touch(succ("ZADD", "key", 2, "b"))},
+		{"ZADD same score", false, []step{zset}, touch(succ("ZADD", "key", 1, "a"))},
+		{"ZINCRBY", true, []step{zset}, touch(succ("ZINCRBY", "key", 1, "a"))},
+		{"ZREM nosuch", false, []step{zset}, touch(succ("ZREM", "key", "nosuch"))},
+
+		// generic
+		{"DEL", true, []step{str}, touch(succ("DEL", "key"))},
+		{"DEL nosuch", false, nil, touch(succ("DEL", "key"))},
+		{"EXPIRE", true, []step{str}, touch(succ("EXPIRE", "key", 100))},
+		{"PERSIST without TTL", false, []step{str}, touch(succ("PERSIST", "key"))},
+		{"RENAME from", true, []step{str}, touch(succ("RENAME", "key", "other"))},
+		{"RENAME to", true, []step{str}, touch(succ("SET", "other", "value"), succ("RENAME", "other", "key"))},
+		{"MOVE", true, []step{str}, touch(succ("MOVE", "key", 1))},
+
+		// databases
+		{"FLUSHDB", true, []step{str}, touch(succ("FLUSHDB"))},
+		{"FLUSHALL", true, []step{str}, touch(succ("FLUSHALL"))},
+		{"FLUSHDB other DB", false, []step{str}, touch(succ("SELECT", 1), succ("FLUSHDB"))},
+		{"SET other DB", false, []step{str}, touch(succ("SELECT", 1), succ("SET", "key", "new"))},
+		{"watch in other DB", false, []step{str, on(0, succ("SELECT", 1))}, touch(succ("SET", "key", "new"))},
+		{"watch and SET in other DB", true, []step{db1, str, on(0, succ("SELECT", 1))}, touch(succ("SET", "key", "new"))},
+
+		// a watched key which expires aborts the transaction since 6.0.9
+		{"expiry", true, []step{on(1, succ("SET", "key", "value", "PX", 100))}, []step{pause(200 * time.Millisecond)}},
+		{"TTL", false, []step{on(1, succ("SET", "key", "value", "EX", 100))}, []step{pause(200 * time.Millisecond)}},
+	}
+	for _, group := range []struct {
+		name  string
+		abort bool
+	}{
+		{"abort", true},
+		{"run", false},
+	} {
+		t.Run(group.name, func(t *testing.T) {
+			for _, c := range cases {
+				if c.abort != group.abort {
+					continue
+				}
+				exec := succ("EXEC").emptyIsNil().expect(length(1))
+				if c.abort {
+					exec = succ("EXEC").emptyIsNil().expect(is(nil))
+				}
+				t.Run(c.name, func(t *testing.T) {
+					steps := append([]step(nil), c.setup...)
+					steps = append(steps, on(0, succ("WATCH", "key")))
+					steps = append(steps, c.touch...)
+					steps = append(steps,
+						on(0, succ("MULTI")),
+						on(0, succ("EXISTS", "key")),
+						on(0, exec),
+					)
+					testSchedule(t, steps...)
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+// Compare replies where the order of elements is undefined.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ordering says how the elements in an array reply are compared.
+type ordering int
+
+const (
+	ordered        ordering = iota
+	unorderedItems          // any order. SMEMBERS, KEYS
+	unorderedPairs          // field/value pairs in any order. HGETALL
+)
+
+// allDepths applies the ordering to every array, no matter how deep.
+const allDepths = -1
+
+// sortReply returns a copy of v where the arrays at `depth` are sorted.
+// Anything which isn't an array is left alone.
+func sortReply(v interface{}, o ordering, depth int) (interface{}, error) {
+	vs, ok := v.([]interface{})
+	if !ok {
+		return v, nil
+	}
+	res := make([]interface{}, len(vs))
+	copy(res, vs)
+
+	if depth != 0 {
+		next := depth - 1
+		if depth == allDepths {
+			next = allDepths
+		}
+		for i, e := range res {
+			s, err := sortReply(e, o, next)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %s", i, err)
+			}
+			res[i] = s
+		}
+		if depth != allDepths {
+			return res, nil
+		}
+	}
+
+	switch o {
+	case unorderedItems:
+		sort.SliceStable(res, func(i, j int) bool {
+			return canonical(res[i]) < canonical(res[j])
+		})
+	case unorderedPairs:
+		if len(res)%2 != 0 {
+			return nil, fmt.Errorf("expected field/value pairs, got %d elements", len(res))
+		}
+		pairs := make([][2]string, 0, len(res)/2)
+		byPair := map[[2]string][2]interface{}{}
+		for i := 0; i < len(res); i += 2 {
+			p := [2]string{canonical(res[i]), canonical(res[i+1])}
+			pairs = append(pairs, p)
+			byPair[p] = [2]interface{}{res[i], res[i+1]}
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			if pairs[i][0] != pairs[j][0] {
+				return pairs[i][0] < pairs[j][0]
+			}
+			return pairs[i][1] < pairs[j][1]
+		})
+		for i, p := range pairs {
+			res[2*i], res[2*i+1] = byPair[p][0], byPair[p][1]
+		}
+	}
+	return res, nil
+}
+
+// canonical is a string representation of a reply, used to sort replies of
+// any type. Bulk strings sort by their content.
+func canonical(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "_"
+	case []byte:
+		return "$" + string(v)
+	case string:
+		return "+" + v
+	case int64:
+		return ":" + strconv.FormatInt(v, 10)
+	case redis.Error:
+		return "-" + string(v)
+	case []interface{}:
+		es := make([]string, len(v))
+		for i, e := range v {
+			es[i] = canonical(e)
+		}
+		return "*[" + strings.Join(es, ",") + "]"
+	default:
+		return fmt.Sprintf("?%#v", v)
+	}
+}
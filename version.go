@@ -0,0 +1,147 @@
+package main
+
+// Redis versions, and commands which only apply to some of them.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// since runs the command only with realredis version v or newer. Older
+// versions skip it, on both servers.
+func (c command) since(v string) command {
+	c.minVersion = v
+	return c
+}
+
+// before runs the command only with realredis versions older than v. Newer
+// versions skip it, on both servers.
+func (c command) before(v string) command {
+	c.maxVersion = v
+	return c
+}
+
+// runsOn is false if the command doesn't apply to this version. An unknown
+// version runs everything.
+func (c command) runsOn(version string) bool {
+	return inVersions(version, c.minVersion, c.maxVersion)
+}
+
+// inVersions is true if version is in [since, before). Empty bounds and an
+// unknown version always match.
+func inVersions(version, since, before string) bool {
+	if version == "" {
+		return true
+	}
+	if since != "" && compareVersions(version, since) < 0 {
+		return false
+	}
+	if before != "" && compareVersions(version, before) >= 0 {
+		return false
+	}
+	return true
+}
+
+// versionGate drops the commands which don't apply to the version, and
+// counts them for the summary.
+func versionGate(t *testing.T, version string, commands []command) []command {
+	t.Helper()
+	var run []command
+	for _, c := range commands {
+		if !c.runsOn(version) {
+			skipCase(t, version, c)
+			continue
+		}
+		run = append(run, c)
+	}
+	return run
+}
+
+// skipped counts the skipped cases: test name -> count.
+var skipped = struct {
+	sync.Mutex
+	tests    map[string]int
+	versions map[string]bool
+}{
+	tests:    map[string]int{},
+	versions: map[string]bool{},
+}
+
+func skipCase(t *testing.T, version string, c command) {
+	t.Helper()
+	t.Logf("skipped for redis %s: %s (since: %q before: %q)", version, commandLine(c), c.minVersion, c.maxVersion)
+	skipped.Lock()
+	defer skipped.Unlock()
+	skipped.tests[t.Name()]++
+	skipped.versions[version] = true
+}
+
+// skipSummary is a line for the end of the run, or "".
+func skipSummary() string {
+	skipped.Lock()
+	defer skipped.Unlock()
+	if len(skipped.tests) == 0 {
+		return ""
+	}
+	n := 0
+	for _, c := range skipped.tests {
+		n += c
+	}
+	var vs []string
+	for v := range skipped.versions {
+		vs = append(vs, v)
+	}
+	sort.Strings(vs)
+	return fmt.Sprintf("skipped %d cases in %d tests, because of redis version %s", n, len(skipped.tests), strings.Join(vs, ", "))
+}
+
+// serverVersion is redis_version from INFO server, or "". INFO might be
+// renamed, then we don't know the version.
+func serverVersion(c redis.Conn) string {
+	info, err := redis.String(c.Do("INFO", "server"))
+	if err != nil {
+		return ""
+	}
+	return infoField(info, "redis_version")
+}
+
+// compareVersions compares "1.2.3" style versions. A leading "v" and
+// anything after a "-" or "+" are ignored. Returns -1, 0, or 1.
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var na, nb int
+		if i < len(pa) {
+			na = pa[i]
+		}
+		if i < len(pb) {
+			nb = pb[i]
+		}
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(p)
+		parts = append(parts, n)
+	}
+	return parts
+}